@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Entries of a diff are applied by a pool of workers. Entry waits for all earlier entries that touch
+// the same path, its parents or its children (and the source of a copy), so the result is the same
+// as if entries were applied one by one. Contents of files are received into temporary files while
+// the diff is read (see receiveFile), so workers only move them into place.
+
+const applyWorkers = 8
+
+type applyTask struct {
+	entry   diffEntry
+	tmpName string // received contents of a file
+	target  []byte // contents of a symlink
+	deps    []chan bool
+	done    chan bool
+}
+
+// applyScheduler finds dependencies between entries of a single diff
+type applyScheduler struct {
+	last  map[string]chan bool   // last entry that touched the path
+	under map[string][]chan bool // entries that touched anything under the dir after the last entry of the dir itself
+}
+
+func newApplyScheduler() *applyScheduler {
+	return &applyScheduler{last: make(map[string]chan bool), under: make(map[string][]chan bool)}
+}
+
+func (s *applyScheduler) add(task *applyTask) {
+	paths := []string{task.entry.file}
+	if task.entry.op == 'C' {
+		if ref := strings.SplitN(task.entry.ref, " ", 2); len(ref) == 2 {
+			paths = append(paths, ref[1])
+		}
+	}
+
+	for _, file := range paths {
+		if dep, ok := s.last[file]; ok {
+			task.deps = append(task.deps, dep)
+		}
+		// e.g. chmod of a directory or its deletion must wait for all writes into it
+		task.deps = append(task.deps, s.under[file]...)
+		for dir := path.Dir(file); ; dir = path.Dir(dir) {
+			if dep, ok := s.last[dir]; ok {
+				task.deps = append(task.deps, dep)
+			}
+			if dir == "." || dir == "/" {
+				break
+			}
+		}
+	}
+
+	// copy only reads its source, but it is simpler to treat it as a change
+	for _, file := range paths {
+		s.last[file] = task.done
+		// later entries of the path wait for this one, and it waits for everything under it
+		delete(s.under, file)
+		for dir := path.Dir(file); ; dir = path.Dir(dir) {
+			s.under[dir] = append(s.under[dir], task.done)
+			if dir == "." || dir == "/" {
+				break
+			}
+		}
+	}
+}
+
+// applyDiff reads diff from r and applies its entries in parallel
+func applyDiff(r io.Reader) {
+	tasks := make(chan *applyTask, applyWorkers)
+	var wg sync.WaitGroup
+
+	for i := 0; i < applyWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for task := range tasks {
+				for _, dep := range task.deps {
+					<-dep
+				}
+				applyEntry(task.entry, task.tmpName, task.target)
+				close(task.done)
+			}
+		}()
+	}
+
+	defer func() {
+		close(tasks)
+		wg.Wait()
+	}()
+
+	scheduler := newApplyScheduler()
+	diff := newDiffReader(r)
+	for {
+		entry, contents, err := diff.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			panic("Cannot read diff from " + hostname + ": " + err.Error())
+		}
+
+		// big file that was being sent before reconnect will not be resumed after it has changed
+		removeBigPartials(entry.file)
+
+		task := &applyTask{entry: entry, done: make(chan bool)}
+		if entry.op == 'A' && entry.stat.isLink {
+			if task.target, err = ioutil.ReadAll(contents); err != nil {
+				panic("Cannot read diff from " + hostname + ": " + err.Error())
+			}
+		} else if entry.op == 'A' && !entry.stat.isDir {
+			task.tmpName = receiveFile(mapPath(entry.file), entry.stat, contents)
+		}
+
+		scheduler.add(task)
+		tasks <- task
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// waitsFor reports whether task waits for other directly or through its dependencies
+func waitsFor(task *applyTask, other *applyTask, tasks []*applyTask) bool {
+	for _, dep := range task.deps {
+		if dep == other.done {
+			return true
+		}
+		for _, t := range tasks {
+			if t.done == dep && waitsFor(t, other, tasks) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestApplySchedulerDeps(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string // "<op> <file>" or "C <file> <source>"
+		waits   [][2]int // task i waits for task j
+		free    [][2]int // task i does not wait for task j
+	}{
+		{"new directory after its files", []string{"A a/x", "A a/y", "A a"}, [][2]int{{2, 0}, {2, 1}}, [][2]int{{1, 0}}},
+		{"deletion after writes into dir", []string{"A a/x", "A a/b/y", "D a"}, [][2]int{{2, 0}, {2, 1}}, nil},
+		{"files after their directory", []string{"A a", "A a/x", "A a/b/y"}, [][2]int{{1, 0}, {2, 0}}, [][2]int{{2, 1}}},
+		{"same file", []string{"A x", "D x", "A x"}, [][2]int{{1, 0}, {2, 1}}, nil},
+		{"independent dirs", []string{"A a/x", "A b/x", "A b"}, [][2]int{{2, 1}}, [][2]int{{1, 0}, {2, 0}}},
+		{"copy waits for source", []string{"A b/x", "C a/y b/x", "D b"}, [][2]int{{1, 0}, {2, 1}}, nil},
+		{"dir twice", []string{"A a/x", "A a", "A a/y", "A a"}, [][2]int{{3, 0}, {3, 1}, {3, 2}}, nil},
+		{"sibling prefix", []string{"A ab/x", "A a"}, nil, [][2]int{{1, 0}}},
+	}
+
+	for _, test := range tests {
+		scheduler := newApplyScheduler()
+		var tasks []*applyTask
+		for _, entry := range test.entries {
+			task := &applyTask{entry: diffEntry{op: entry[0], file: entry[2:]}, done: make(chan bool)}
+			if task.entry.op == 'C' {
+				parts := bytes.SplitN([]byte(entry[2:]), []byte(" "), 2)
+				task.entry.file, task.entry.ref = string(parts[0]), "hash "+string(parts[1])
+			}
+			scheduler.add(task)
+			tasks = append(tasks, task)
+		}
+
+		for _, pair := range test.waits {
+			if !waitsFor(tasks[pair[0]], tasks[pair[1]], tasks) {
+				t.Errorf("%s: %q does not wait for %q", test.name, test.entries[pair[0]], test.entries[pair[1]])
+			}
+		}
+		for _, pair := range test.free {
+			if waitsFor(tasks[pair[0]], tasks[pair[1]], tasks) {
+				t.Errorf("%s: %q waits for %q", test.name, test.entries[pair[0]], test.entries[pair[1]])
+			}
+		}
+	}
+}
+
+func TestApplyDiffReadOnlyDir(t *testing.T) {
+	if os.Getuid() == 0 {
+		t.Skip("root can write into read-only directories")
+	}
+	chdirTemp(t)
+
+	file := UnrealStat{mode: 0644, mtime: 1, size: 3}.Serialize()
+	dir := UnrealStat{isDir: true, mode: 0555, mtime: 1}.Serialize()
+	var diff bytes.Buffer
+	for i := 0; i < 50; i++ {
+		diff.WriteString("A a/" + string(rune('a'+i%26)) + string(rune('a'+i/26)) + "\n" + file + diffSep + "abc")
+	}
+	diff.WriteString("A a\n" + dir + diffSep)
+	applyDiff(&diff)
+
+	entries, err := os.ReadDir("a")
+	if err != nil || len(entries) != 50 {
+		t.Errorf("a has %d entries (%v), want 50", len(entries), err)
+	}
+	os.Chmod("a", 0755)
+}
+
+func TestApplyDiffDeleteAfterWrite(t *testing.T) {
+	chdirTemp(t)
+
+	file := UnrealStat{mode: 0644, mtime: 1, size: 3}.Serialize()
+	var diff bytes.Buffer
+	for i := 0; i < 50; i++ {
+		diff.WriteString("A a/b/" + string(rune('a'+i%26)) + string(rune('a'+i/26)) + "\n" + file + diffSep + "abc")
+	}
+	diff.WriteString("D a" + diffSep)
+	applyDiff(&diff)
+
+	if _, err := os.Lstat("a"); !os.IsNotExist(err) {
+		t.Errorf("a exists after deletion: %v", err)
+	}
+}
+
+// chdirTemp makes temporary directory the synced one for the test
+func chdirTemp(t *testing.T) {
+	oldDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldRepoPath := repoPath
+	t.Cleanup(func() {
+		os.Chdir(oldDir)
+		repoPath = oldRepoPath
+	})
+
+	dir := t.TempDir()
+	if err = os.MkdirAll(filepath.Join(dir, defaultRepoDir, repoTmp), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	repoPath = defaultRepoDir
+}
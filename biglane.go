@@ -0,0 +1,143 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Big files are sent by a separate goroutine, so that small changes that come after them in the log
+// do not wait for the whole big file: chunks of big files and diffs are interleaved in ssh stdin.
+// Diffs that touch a path which is still being sent wait for it to finish to keep the order of changes.
+
+const bigFileLaneSize = 1000
+
+type bigFileLane struct {
+	sync.Mutex
+	queue   chan []byte
+	pending map[string]int
+}
+
+func newBigFileLane() *bigFileLane {
+	lane := &bigFileLane{}
+	lane.reset(nil)
+	return lane
+}
+
+// reset forgets big files of the previous connection, initial sync sends them anyway except for
+// the resumed ones: they are counted as pending right away and must be put into the returned queue
+func (l *bigFileLane) reset(resumed [][]byte) chan []byte {
+	l.Lock()
+	defer l.Unlock()
+
+	l.queue = make(chan []byte, bigFileLaneSize)
+	l.pending = make(map[string]int)
+	for _, ref := range resumed {
+		file, _ := parseBigFilePayload(ref)
+		l.pending[file]++
+	}
+	return l.queue
+}
+
+// unfinished returns big files that were not sent before the connection was lost
+func (l *bigFileLane) unfinished() (files []string) {
+	l.Lock()
+	defer l.Unlock()
+
+	for file := range l.pending {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return
+}
+
+// add queues reference to the big file (see actionBigRef) for sending
+func (l *bigFileLane) add(ref []byte, stopCh chan bool) bool {
+	file, _ := parseBigFilePayload(ref)
+
+	l.Lock()
+	l.pending[file]++
+	queue := l.queue
+	l.Unlock()
+
+	select {
+	case queue <- append([]byte(nil), ref...):
+		return true
+	case <-stopCh:
+		return false
+	}
+}
+
+func (l *bigFileLane) done(file string) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.pending[file]--; l.pending[file] <= 0 {
+		delete(l.pending, file)
+	}
+}
+
+func (l *bigFileLane) idle() bool {
+	l.Lock()
+	defer l.Unlock()
+
+	return len(l.pending) == 0
+}
+
+// conflicts reports whether diff changes any of the big files that are being sent, their parents or children
+func (l *bigFileLane) conflicts(diff []byte) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	if len(l.pending) == 0 {
+		return false
+	}
+
+	result := false
+	forEachDiffEntry(diff, func(entry diffEntry) {
+		files := []string{entry.file}
+		if entry.op == 'C' {
+			// copy source must be sent before it is copied
+			if parts := strings.SplitN(entry.ref, " ", 2); len(parts) == 2 {
+				files = append(files, parts[1])
+			}
+		}
+
+		for bigFile := range l.pending {
+			for _, file := range files {
+				if file == bigFile || strings.HasPrefix(bigFile, file+"/") || strings.HasPrefix(file, bigFile+"/") {
+					result = true
+				}
+			}
+		}
+	})
+	return result
+}
+
+// wait blocks until cond is false, returns false if client was stopped
+func (l *bigFileLane) wait(cond func() bool, stopCh chan bool) bool {
+	for cond() {
+		select {
+		case <-stopCh:
+			return false
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	return true
+}
+
+func (r *Client) bigFileThread(queue chan []byte) {
+	for {
+		select {
+		case <-r.stopCh:
+			return
+		case ref := <-queue:
+			if !r.sendBigFile(ref) {
+				return
+			}
+			file, _ := parseBigFilePayload(ref)
+			r.bigFiles.done(file)
+		}
+	}
+}
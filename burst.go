@@ -0,0 +1,94 @@
+package main
+
+import "errors"
+
+// Operations like git checkout change thousands of files at once. Pushing all of them through
+// the log is often slower than a single rsync, so when one aggregation window has more than
+// burstFiles changes or burstSize bytes we skip the log and ask every server for bulk resync.
+
+const (
+	defaultBurstFiles = 2000
+	defaultBurstSize  = 128 * 1048576
+)
+
+var (
+	burstFiles       = defaultBurstFiles
+	burstSize  int64 = defaultBurstSize
+)
+
+// commitChanges writes pending changes to the log or requests bulk resync if there are too many of them.
+// Must be called with repo locked
+func commitChanges(clients map[string]*Client) {
+	changes := pendingChanges
+	pendingChanges = nil
+
+	if isBurst(changes) {
+		progressLn("Too many changes (", len(changes), " files), requesting bulk resync")
+		for _, client := range clients {
+			// changes are not in the log, so server is not synced until resync finishes
+			client.setSynced(false)
+			select {
+			case client.resyncCh <- true:
+			default:
+				// resync is already requested
+			}
+		}
+		return
+	}
+
+	first, rest := prioritize(changes)
+	for _, change := range first {
+		localDiff.Add(change.file, change.stat)
+	}
+	// priority changes get their own diff, so that they do not wait for the rest
+	localDiff.Commit()
+	for _, change := range rest {
+		localDiff.Add(change.file, change.stat)
+	}
+	localDiff.Commit()
+}
+
+func isBurst(changes []fileChange) bool {
+	if burstFiles != 0 && len(changes) > burstFiles {
+		return true
+	}
+	if burstSize == 0 {
+		return false
+	}
+
+	var size int64
+	for _, change := range changes {
+		if change.stat != nil && !change.stat.isDir {
+			size += change.stat.size
+		}
+	}
+	return size > burstSize
+}
+
+// bulkResync skips everything that is pending in the log for the server and syncs the whole
+// directory instead: the sync starts after the skipped entries were written, so it covers them
+func (r *Client) bulkResync() error {
+	progressLn("Bulk resync of " + r.settings.host + "...")
+	if !r.bigFiles.wait(func() bool { return !r.bigFiles.idle() }, r.stopCh) {
+		return errors.New("Stopped while waiting for big files of " + r.settings.host)
+	}
+	r.setSynced(false)
+	if err := openOutLogForRead(r.settings.host, true); err != nil {
+		return err
+	}
+
+	if r.settings.reconcile {
+		if !r.reconcile() {
+			return errors.New("Bulk reconciliation with " + r.settings.host + " failed")
+		}
+		r.setSynced(true)
+		return nil
+	}
+
+	if err := r.rsync(nil); err != nil {
+		return err
+	}
+	r.setSynced(true)
+	progressLn("Bulk resync of " + r.settings.host + " finished")
+	return nil
+}
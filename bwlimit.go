@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"math"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/glacjay/goini"
+	"github.com/unrealsync/unrealsync/list"
+)
+
+// Bandwidth limit is applied to everything that is written into ssh stdin of the server and is passed
+// to rsync. Limits from client_config are re-read on SIGHUP, so they can be changed without restart.
+
+// bwLimitChunkSize is the size of a single write into ssh stdin when bandwidth is limited
+const bwLimitChunkSize = 32 * 1024
+
+type bwLimiter struct {
+	sync.Mutex
+	rate int64 // bytes per second, 0 means unlimited
+	next time.Time
+}
+
+func newBwLimiter(rate int64) *bwLimiter {
+	return &bwLimiter{rate: rate}
+}
+
+func (l *bwLimiter) setRate(rate int64) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.rate = rate
+	l.next = time.Time{}
+}
+
+func (l *bwLimiter) getRate() int64 {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.rate
+}
+
+// wait accounts n written bytes and sleeps so that average rate does not exceed the limit.
+// Returns false if stopped
+func (l *bwLimiter) wait(n int, stopCh chan bool) bool {
+	l.Lock()
+	if l.rate == 0 {
+		l.Unlock()
+		return true
+	}
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	delay := l.next.Sub(now)
+	l.Unlock()
+
+	if delay <= 0 {
+		return true
+	}
+	select {
+	case <-time.After(delay):
+		return true
+	case <-stopCh:
+		return false
+	}
+}
+
+// write writes buf into w in small chunks respecting the limit
+func (l *bwLimiter) write(w io.Writer, buf []byte, stopCh chan bool) error {
+	if l.getRate() == 0 {
+		_, err := w.Write(buf)
+		return err
+	}
+
+	for len(buf) > 0 {
+		n := bwLimitChunkSize
+		if n > len(buf) {
+			n = len(buf)
+		}
+		if _, err := w.Write(buf[0:n]); err != nil {
+			return err
+		}
+		if !l.wait(n, stopCh) {
+			return errors.New("Stopped while writing")
+		}
+		buf = buf[n:]
+	}
+	return nil
+}
+
+// parseBwLimit parses values like "2MB/s", "512K", "1.5 MiB/s" or "100000" (bytes per second)
+func parseBwLimit(value string) (int64, error) {
+	return parseSize(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "/S"))
+}
+
+// parseSize parses values like "2MB", "512K", "1.5 GiB" or "100000" (bytes)
+func parseSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	multiplier := 1.0
+	for _, unit := range []struct {
+		suffix     string
+		multiplier float64
+	}{
+		{"KIB", 1024}, {"MIB", 1048576}, {"GIB", 1073741824},
+		{"KB", 1024}, {"MB", 1048576}, {"GB", 1073741824},
+		{"K", 1024}, {"M", 1048576}, {"G", 1073741824},
+		{"B", 1},
+	} {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSuffix(value, unit.suffix)
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return 0, err
+	}
+	if number < 0 {
+		return 0, errors.New("size cannot be negative")
+	}
+	size := number * multiplier
+	if math.IsInf(size, 0) || math.IsNaN(size) {
+		return 0, errors.New("size must be a number")
+	}
+	// float64(math.MaxInt64) is 2^63 that does not fit into int64 itself
+	if size >= math.MaxInt64 {
+		return 0, errors.New("size is too big")
+	}
+	return int64(size), nil
+}
+
+// rsyncBwLimit converts rate to the value of rsync --bwlimit that is in KiB per second
+func rsyncBwLimit(rate int64) string {
+	kbps := rate / 1024
+	if kbps < 1 {
+		kbps = 1
+	}
+	return strconv.FormatInt(kbps, 10)
+}
+
+func bwLimitThread(clients map[string]*Client) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		reloadBwLimits(clients)
+	}
+}
+
+// reloadBwLimits applies bwlimit values from client_config to running clients
+func reloadBwLimits(clients map[string]*Client) {
+	dict, err := ini.Load(repoConfigFilename)
+	if err != nil {
+		progressLn("Cannot reload bwlimit from ", repoConfigFilename, ": ", err)
+		return
+	}
+
+	general := dict[generalSection]
+	for section, serverSettings := range dict {
+		if section == "" || section == generalSection {
+			continue
+		}
+
+		value := serverSettings["bwlimit"]
+		if value == "" {
+			value = general["bwlimit"]
+		}
+
+		keys, err := list.Expand(section)
+		if err != nil {
+			progressLn("Server name pattern '", section, "' parse error: ", err)
+			continue
+		}
+
+		for _, key := range keys {
+			client, ok := clients[key]
+			if !ok {
+				continue
+			}
+
+			var rate int64
+			if value != "" {
+				if rate, err = parseBwLimit(value); err != nil {
+					progressLn("Cannot parse 'bwlimit' property in [", section, "] section of ", repoConfigFilename, ": ", err)
+					continue
+				}
+			}
+
+			if rate != client.bwLimit.getRate() {
+				client.bwLimit.setRate(rate)
+				if rate == 0 {
+					progressLn("Bandwidth limit for ", key, " removed")
+				} else {
+					progressLn("Bandwidth limit for ", key, " set to ", formatLength(int(rate)), "/s")
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{"100000", 100000, false},
+		{"0", 0, false},
+		{"512B", 512, false},
+		{"512K", 512 * 1024, false},
+		{"512kb", 512 * 1024, false},
+		{"2MB", 2 * 1048576, false},
+		{"2 MiB", 2 * 1048576, false},
+		{"1.5 GiB", 1610612736, false},
+		{" 1g ", 1073741824, false},
+		{"", 0, true},
+		{"MB", 0, true},
+		{"-1K", 0, true},
+		{"10TB", 0, true},
+		{"inf", 0, true},
+		{"nan", 0, true},
+		{"1e30", 0, true},
+		{"1e19", 0, true},
+		{"9000000000G", 0, true},
+		{"8000000000G", 8589934592000000000, false},
+	}
+
+	for _, test := range tests {
+		got, err := parseSize(test.value)
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d, error %v", test.value, got, err, test.want, test.wantErr)
+		}
+	}
+}
@@ -6,50 +6,94 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/unrealsync/fswatcher"
 )
 
+// DiffWriter collects changes into diffs and passes them to write: either into out.log
+// or directly to a single server when reconciling with it
+type DiffWriter struct {
+	buf   [maxDiffSize]byte
+	ptr   int
+	write func(action string, buf []byte)
+
+	// big files are not put into diffs, they are passed here instead
+	bigFile func(file string, stat *UnrealStat)
+
+	// files with contents that were already sent are written as copies of existing files,
+	// requires repo to be locked
+	detectCopies bool
+}
+
+// fileChange is the state of the file that should be sent to server, nil stat means deletion
+type fileChange struct {
+	file string
+	stat *UnrealStat
+}
+
 var (
-	repo         *Repository
-	localDiff    [maxDiffSize]byte
-	localDiffPtr int
+	repo      *Repository
+	repoReady = make(chan bool)
+	localDiff = &DiffWriter{write: writeToOutLog, bigFile: writeBigFileRef, detectCopies: true}
+
+	// changes found by syncDir that are not committed yet
+	pendingChanges []fileChange
 )
 
-func waitWatcherReady(fschanges chan string) {
+func waitWatcherReady(fschanges chan string, watchers int) {
 	debugLn("Waiting for watcher")
-	for {
+	for watchers > 0 {
 		change := <-fschanges
 		debugLn("got ", string(change), " from Watcher")
 		if change == fswatcher.LOCAL_WATCHER_READY {
-			progressLn("Watcher ready")
-			break
+			watchers--
 		}
 	}
+	progressLn("Watcher ready")
 }
 
-func commitDiff() {
-	if localDiffPtr == 0 {
+func (d *DiffWriter) Commit() {
+	if d.ptr == 0 {
 		return
 	}
 
-	buf := localDiff[0:localDiffPtr]
-	writeToOutLog(actionDiff, buf)
+	buf := d.buf[0:d.ptr]
+	d.write(actionDiff, buf)
 
-	localDiffPtr = 0
+	d.ptr = 0
 
 	return
 }
 
+// bigFilePayload is used for actionBigInit, actionBigCommit and actionBigRef:
+// filename length (10 bytes) | filename | serialized stat
+func bigFilePayload(fileStr string, stat *UnrealStat) []byte {
+	return []byte(fmt.Sprintf("%010d%s%s", len(fileStr), fileStr, stat.Serialize()))
+}
+
+func parseBigFilePayload(buf []byte) (fileStr string, stat UnrealStat) {
+	filenameLen, err := strconv.ParseInt(string(buf[0:10]), 10, 32)
+	if err != nil {
+		panic("Cannot parse big filename length")
+	}
+
+	fileStr = string(buf[10 : 10+filenameLen])
+	stat = UnrealStatUnserialize(string(buf[10+filenameLen:]))
+	stat.name = fileStr
+	return
+}
+
 // Send big file in chunks:
-// actionBigInit  = filename
-// actionBigRcv   = filename length (10 bytes) | filename | chunk contents
+// actionBigInit  = filename length (10 bytes) | filename | serialized stat
+// actionBigRcv   = filename length (10 bytes) | filename | offset (20 bytes) | chunk contents
 // actionBigAbort = filename
-func commitBigFile(fileStr string, stat *UnrealStat) {
-	progressLn("Sending big file: ", fileStr, " (", stat.size/1024/1024, " MiB)")
-
+// Server keeps partially received files and replies to actionBigInit with actionBigHave that
+// contains number of bytes it already has, so that transfer interrupted by reconnect can be resumed.
+// Transfer is aborted if file changes while we are reading it
+func (r *Client) commitBigFile(fileStr string, stat *UnrealStat) {
 	fp, err := os.Open(fileStr)
 	if err != nil {
 		progressLn("Could not open ", fileStr, ": ", err)
@@ -57,19 +101,41 @@ func commitBigFile(fileStr string, stat *UnrealStat) {
 	}
 	defer fp.Close()
 
-	dir := filepath.Dir(fileStr)
-	if !repo.HasDir(dir) {
-		repo.AddDir(dir)
+	// there will be newer change in the log if file has changed since stat was taken
+	if fileStat, err := fp.Stat(); err != nil || !StatsEqual(UnrealStatFromStat(fileStr, fileStat), *stat) {
+		progressLn("Big file ", fileStr, " has changed, skipping it")
+		return
 	}
-	repo.AddFileToDir(dir, filepath.Base(fileStr), stat)
 
-	file := []byte(fileStr)
+	// server knows the file by its converted name, see remoteName
+	remoteFile, ok := r.remoteName(fileStr)
+	if !ok {
+		return
+	}
 
-	writeToOutLog(actionBigInit, file)
-	bytesLeft := stat.size
+	offsetCh := r.expectBigOffset(remoteFile)
+	r.sendToServer(actionBigInit, bigFilePayload(remoteFile, stat))
+	offset := r.waitBigOffset(remoteFile, offsetCh)
 
-	for {
-		buf := make([]byte, maxDiffSize/2)
+	if offset > 0 {
+		progressLn("Resuming big file: ", fileStr, " (", stat.size/1024/1024, " MiB) from ", formatLength(int(offset)))
+		if _, err = fp.Seek(offset, io.SeekStart); err != nil {
+			progressLn("Cannot seek ", fileStr, ": ", err)
+			r.sendToServer(actionBigAbort, []byte(remoteFile))
+			return
+		}
+	} else {
+		progressLn("Sending big file: ", fileStr, " (", stat.size/1024/1024, " MiB)")
+	}
+
+	r.bigProgress.start(fileStr, offset, stat.size)
+	defer r.bigProgress.finish()
+
+	file := []byte(remoteFile)
+	bytesLeft := stat.size - offset
+
+	for bytesLeft > 0 {
+		buf := make([]byte, bigFileChunkSize)
 		bufOffset := 0
 
 		copy(buf[bufOffset:10], fmt.Sprintf("%010d", len(file)))
@@ -78,51 +144,62 @@ func commitBigFile(fileStr string, stat *UnrealStat) {
 		copy(buf[bufOffset:len(file)+bufOffset], file)
 		bufOffset += len(file)
 
+		copy(buf[bufOffset:bufOffset+20], fmt.Sprintf("%020d", offset))
+		bufOffset += 20
+
 		fileStat, err := fp.Stat()
 		if err != nil {
 			progressLn("Cannot stat ", fileStr, " that we are reading right now: ", err.Error())
-			writeToOutLog(actionBigAbort, []byte(file))
+			r.sendToServer(actionBigAbort, file)
 			return
 		}
 
 		newStat := UnrealStatFromStat(fileStr, fileStat)
 		if !StatsEqual(newStat, *stat) {
 			progressLn("File ", fileStr, " has changed, aborting transfer")
-			writeToOutLog(actionBigAbort, []byte(file))
+			r.sendToServer(actionBigAbort, file)
 			return
 		}
 
 		n, err := fp.Read(buf[bufOffset:])
 		if err != nil && err != io.EOF {
 			// if we were unable to read file that we just opened then probably there are some problems with the OS
-			progressLn("Cannot read ", file, ": ", err)
-			writeToOutLog(actionBigAbort, []byte(file))
+			progressLn("Cannot read ", fileStr, ": ", err)
+			r.sendToServer(actionBigAbort, file)
 			return
 		}
 
 		if n != len(buf)-bufOffset && int64(n) != bytesLeft {
-			progressLn("Read different number of bytes than expected from ", file)
-			writeToOutLog(actionBigAbort, []byte(file))
+			progressLn("Read different number of bytes than expected from ", fileStr)
+			r.sendToServer(actionBigAbort, file)
 			return
 		}
 
-		writeToOutLog(actionBigRcv, buf[0:bufOffset+n])
+		r.sendToServer(actionBigRcv, buf[0:bufOffset+n])
+		r.bigProgress.add(int64(n))
 
-		if bytesLeft -= int64(n); bytesLeft == 0 {
-			break
-		}
+		offset += int64(n)
+		bytesLeft -= int64(n)
 	}
 
-	writeToOutLog(actionBigCommit, []byte(fmt.Sprintf("%010d%s%s", len(file), fileStr, stat.Serialize())))
+	r.sendToServer(actionBigCommit, bigFilePayload(remoteFile, stat))
 
 	progressLn("Big file ", fileStr, " successfully sent")
 
 	return
 }
 
-func addToDiff(file string, stat *UnrealStat) {
+// writeBigFileRef puts reference to the big file into the log instead of its contents
+func writeBigFileRef(fileStr string, stat *UnrealStat) {
+	writeToOutLog(actionBigRef, bigFilePayload(fileStr, stat))
+}
+
+// Add puts change into the current diff. Contents are read directly into the diff buffer, so memory
+// usage does not depend on the number or size of changed files. Files bigger than bigFileThreshold
+// are sent separately in chunks so that they do not delay diffs with small files
+func (d *DiffWriter) Add(file string, stat *UnrealStat) {
 	var diffLen int64
-	var buf, diffHeader []byte
+	var diffHeader []byte
 
 	if stat == nil {
 		diffHeader = []byte("D " + file + diffSep)
@@ -133,63 +210,89 @@ func addToDiff(file string, stat *UnrealStat) {
 		}
 	}
 
-	if diffLen > maxDiffSize/2 {
-		commitBigFile(file, stat)
+	// big files are not hashed here as it would block the repository for too long
+	if d.detectCopies && stat != nil && !stat.isDir && !stat.isLink && stat.size >= minCopySize && stat.size <= bigFileThreshold && d.addCopy(file, stat) {
 		return
 	}
 
-	if localDiffPtr+int(diffLen)+len(diffHeader) >= maxDiffSize-1 {
-		progressLn("Diff too big:", localDiffPtr+int(diffLen)+len(diffHeader), " >= ", maxDiffSize-1, " autocommit")
-		commitDiff()
+	if diffLen > bigFileThreshold {
+		d.bigFile(file, stat)
+		return
 	}
 
+	if d.ptr+int(diffLen)+len(diffHeader) >= maxDiffSize-1 {
+		progressLn("Diff too big:", d.ptr+int(diffLen)+len(diffHeader), " >= ", maxDiffSize-1, " autocommit")
+		d.Commit()
+	}
+
+	start := d.ptr
+	d.ptr += copy(d.buf[d.ptr:], diffHeader)
+
 	if stat != nil && diffLen > 0 {
+		contents := d.buf[d.ptr : d.ptr+int(diffLen)]
+
 		if stat.isLink {
-			bufStr, err := os.Readlink(file)
+			target, err := os.Readlink(file)
 			if err != nil {
 				progressLn("Could not read link " + file)
+				d.ptr = start
 				return
 			}
 
-			buf = []byte(bufStr)
-
-			if len(buf) != int(diffLen) {
+			if len(target) != int(diffLen) {
 				progressLn("Readlink different number of bytes than expected from ", file)
+				d.ptr = start
 				return
 			}
+			copy(contents, target)
 		} else {
 			fp, err := os.Open(file)
 			if err != nil {
 				progressLn("Could not open ", file, ": ", err)
+				d.ptr = start
 				return
 			}
 			defer fp.Close()
 
-			buf = make([]byte, diffLen)
-			n, err := fp.Read(buf)
-			if err != nil && err != io.EOF {
-				// if we were unable to read file that we just opened then probably there are some problems with the OS
+			if _, err := io.ReadFull(fp, contents); err != nil {
+				// file is either unreadable or has changed, newer change will be sent in the latter case
 				progressLn("Cannot read ", file, ": ", err)
-				return
-			}
-
-			if n != int(diffLen) {
-				progressLn("Read different number of bytes than expected from ", file)
+				d.ptr = start
 				return
 			}
 		}
+
+		d.ptr += int(diffLen)
 	}
+}
 
-	localDiffPtr += copy(localDiff[localDiffPtr:], diffHeader)
+// addCopy writes "copy from existing path" entry instead of file contents if the same contents were
+// already sent. Entry format is "C file\nstat\nhash source". Server checks the hash of its copy of source
+// and asks for the contents (see actionCopyMiss) if it does not match
+func (d *DiffWriter) addCopy(file string, stat *UnrealStat) bool {
+	hash, err := stat.Hash()
+	if err != nil {
+		debugLn("Cannot hash ", file, ": ", err)
+		return false
+	}
 
-	if stat != nil && diffLen > 0 {
-		localDiffPtr += copy(localDiff[localDiffPtr:], buf)
+	source, ok := repo.FindContent(hash, file)
+	repo.AddContent(hash, file, stat)
+	if !ok {
+		return false
 	}
 
-	return
+	diffHeader := []byte("C " + file + "\n" + stat.Serialize() + "\n" + hash + " " + source + diffSep)
+	if d.ptr+len(diffHeader) >= maxDiffSize-1 {
+		d.Commit()
+	}
+	d.ptr += copy(d.buf[d.ptr:], diffHeader)
+
+	debugLn("Sending ", file, " as a copy of ", source)
+	return true
 }
 
-func aggregateDirs(dirschan chan string) {
+func aggregateDirs(dirschan chan string, clients map[string]*Client) {
 	dirs := make(map[string]bool)
 	tick := time.Tick(dirAggregateInterval)
 
@@ -205,11 +308,18 @@ func aggregateDirs(dirschan chan string) {
 				continue
 			}
 
+			repo.Lock()
 			for dir := range dirs {
+				// watcher may report only a new directory itself, so its parent must be synced
+				// for the directory to become a part of repository
+				for dir != "." && !repo.HasDir(dir) {
+					dir = filepath.Dir(dir)
+				}
 				progressLn("Changed dir: ", dir)
 				syncDir(dir, false, true)
 			}
-			commitDiff()
+			commitChanges(clients)
+			repo.Unlock()
 			dirs = make(map[string]bool)
 		}
 	}
@@ -236,7 +346,7 @@ func getPathToSync(path string) (string, error) {
 	} else if !stat.IsDir() {
 		path = filepath.Dir(path)
 	}
-	if repo.IsPathExcluded(path) {
+	if repo.IsPathExcluded(path, true) {
 		return "", errors.New("excluded folder change")
 	}
 	return path, nil
@@ -269,62 +379,116 @@ func syncDir(dir string, recursive, sendChanges bool) {
 		return
 	}
 
+	// files that were ignored may become included, so the whole subtree must be checked
+	if repo.LoadIgnoreFiles(dir) && !recursive {
+		progressLn("Ignore rules changed in ", dir)
+		recursive = true
+	}
+
 	if !repo.HasDir(dir) {
 		debugLn("No dir ", dir, " in repo")
 		repo.AddDir(dir)
 	}
 	repoInfo := repo.GetDirStat(dir)
+	infos, prefetched := scanned.listing(dir)
+	names := make(map[string]bool, len(infos))
+	for _, info := range infos {
+		names[info.Name()] = true
+	}
 
 	// Detect deletions: we need to do it first because otherwise change from dir to file will be impossible
 	for name := range repoInfo {
-		_, err := os.Lstat(dir + "/" + name)
+		if prefetched {
+			if names[name] {
+				continue
+			}
+			err = os.ErrNotExist
+		} else {
+			_, err = os.Lstat(dir + "/" + name)
+		}
+
 		if os.IsNotExist(err) {
+			if repoInfo[name].isDir {
+				repo.RemoveDir(filepath.Join(dir, name))
+			}
 			delete(repoInfo, name)
 			debugLn("Deleted: ", dir, "/", name)
 			if sendChanges {
-				addToDiff(dir+"/"+name, nil)
+				pendingChanges = append(pendingChanges, fileChange{dir + "/" + name, nil})
 			}
 		} else if err != nil {
 			fatalLn("Could not lstat ", dir, "/", name, ": ", err)
 		}
 	}
 
-	for {
-		res, err := fp.Readdir(10)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
+	syncEntry := func(info os.FileInfo) {
+		repoEl, ok := repoInfo[info.Name()]
+		filePath := filepath.Join(dir, info.Name())
+		if repo.IsPathExcluded(filePath, info.IsDir()) {
+			return
+		}
+		if reason := repo.excludes.Skips(filePath, info.Mode(), info.Size()); reason != "" {
+			repo.skipped.report(filePath, reason)
+			return
+		}
+		unrealStat := UnrealStatFromStat(filepath.Join(dir, info.Name()), info)
+		unrealStat.hash = scanned.hash(filePath)
+		changed := !ok || !StatsEqual(unrealStat, *repoEl)
 
-			progressLn("Could not read directory names from " + dir + ": " + err.Error())
-			break
+		// directory stat does not reflect changes deep inside it, so recursive sync must visit every directory
+		if info.IsDir() && (recursive || changed && (!ok || !repoEl.isDir)) {
+			syncDir(filePath, true, sendChanges)
 		}
 
-		for _, info := range res {
-			repoEl, ok := repoInfo[info.Name()]
-			filePath := filepath.Join(dir, info.Name())
-			if repo.IsPathExcluded(filePath) {
-				continue
-			}
-			unrealStat := UnrealStatFromStat(filepath.Join(dir, info.Name()), info)
+		if changed {
+			repoInfo[info.Name()] = &unrealStat
 
-			if !ok || !StatsEqual(unrealStat, *repoEl) {
-				if info.IsDir() && (recursive || !ok || !repoEl.isDir) {
-					syncDir(filePath, true, sendChanges)
+			prefix := "Changed: "
+			if !ok {
+				prefix = "Added: "
+			}
+			debugLn(prefix, filePath)
+			if sendChanges {
+				pendingChanges = append(pendingChanges, fileChange{filePath, &unrealStat})
+			} else if hashCheck { // todo: move repository initialization in separate method
+				// to calculate hash when we initialize repository so that we will have some hashes on sync
+				if _, err := unrealStat.Hash(); err != nil {
+					debugLn("Cannot hash ", filePath, ": ", err)
 				}
+			}
+		}
+	}
 
-				repoInfo[info.Name()] = &unrealStat
-
-				prefix := "Changed: "
-				if !ok {
-					prefix = "Added: "
+	if names := repo.excludes.sparseChildren(dir); names != nil {
+		// directory on the way to sparse paths is not read, only the entries that lead to them
+		for _, name := range names {
+			info, err := os.Lstat(filepath.Join(dir, name))
+			if err != nil {
+				if !os.IsNotExist(err) {
+					progressLn("Cannot stat ", filepath.Join(dir, name), ": ", err)
 				}
-				debugLn(prefix, filePath)
-				if sendChanges {
-					addToDiff(filePath, &unrealStat)
-				} else if hashCheck { // todo: move repository initialization in separate method
-					unrealStat.Hash() // to calculate hash when we initialize repository so that we will have some hashes on sync
+				continue
+			}
+			syncEntry(info)
+		}
+	} else if prefetched {
+		for _, info := range infos {
+			syncEntry(info)
+		}
+	} else {
+		for {
+			res, err := fp.Readdir(10)
+			if err != nil {
+				if err == io.EOF {
+					break
 				}
+
+				progressLn("Could not read directory names from " + dir + ": " + err.Error())
+				break
+			}
+
+			for _, info := range res {
+				syncEntry(info)
 			}
 		}
 	}
@@ -339,29 +503,50 @@ func pingThread() {
 	}
 }
 
-func doClient(servers map[string]Settings, globalExcludes map[string]bool) {
+func doClient(servers map[string]Settings, globalExcludes *Excludes) {
 	if len(servers) == 0 {
 		servers, globalExcludes = parseConfig()
 	}
 
 	repo = NewRepository(globalExcludes)
+	syncedServers := make(map[string]bool)
+	indexLoaded := false
+	if indexRepo, indexServers, err := loadIndex(globalExcludes); err == nil {
+		progressLn("Loaded index, validating it")
+		repo, syncedServers, indexLoaded = indexRepo, indexServers, true
+		if len(syncedServers) > 0 {
+			// synced servers are trusted only once: drop them so that a crash does not reuse them
+			repo.Lock()
+			saveIndex(nil)
+			repo.Unlock()
+		}
+	} else if !os.IsNotExist(err) {
+		progressLn("Cannot load index: ", err)
+	}
 
 	clients := make(map[string]*Client)
 	for key, settings := range servers {
 		clients[key] = MakeClient(settings)
+		clients[key].skipInitialSync = syncedServers[serverIndexKey(settings)]
 		go clients[key].startServer()
 
 	}
 	go pingThread()
 
 	dirschan := make(chan string, 10000)
-	go fswatcher.RunWatcher(sourceDir, dirschan)
-	waitWatcherReady(dirschan)
-
-	syncDir(".", true, false)
+	waitWatcherReady(dirschan, startWatchers(dirschan))
+
+	// when index is loaded we send everything that has changed since it was saved
+	repo.Lock()
+	syncTree(".", indexLoaded)
+	commitChanges(clients)
+	repo.Unlock()
+	close(repoReady)
 	go printStatusThread(clients)
+	go indexThread(clients)
+	go bwLimitThread(clients)
 
 	// read watcher
 	progressLn("Entering watcher loop")
-	aggregateDirs(dirschan)
+	aggregateDirs(dirschan, clients)
 }
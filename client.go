@@ -1,13 +1,18 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -15,35 +20,196 @@ type Client struct {
 	settings Settings
 	stopCh   chan bool
 	errorCh  chan error
+	stream   chan BufBlocker
+	treeCh   chan []byte
+	resyncCh chan bool
+	verifyCh chan bool
+	bigFiles *bigFileLane
+
+	// replies to actionBigInit by filename
+	bigOffsets      map[string]chan int64
+	bigOffsetsMutex sync.Mutex
+
+	// files that server could not copy, see queueCopyMiss
+	copyMisses      []string
+	copyMissesMutex sync.Mutex
+	copyMissCh      chan bool
+
+	bigProgress  transferProgress
+	syncProgress transferProgress
+
+	bwLimit *bwLimiter
+	skipped skipReporter
+
+	// server already has everything from the index, so it needs only the changes found when validating it
+	skipInitialSync bool
+
+	// server has everything before the log reader, see setSynced
+	synced      bool
+	syncedMutex sync.Mutex
 }
 
 func MakeClient(settings Settings) *Client {
-	return &Client{settings: settings}
+	return &Client{
+		settings:   settings,
+		resyncCh:   make(chan bool, 1),
+		verifyCh:   make(chan bool, 1),
+		copyMissCh: make(chan bool, 1),
+		bigFiles:   newBigFileLane(),
+		bigOffsets: make(map[string]chan int64),
+		bwLimit:    newBwLimiter(settings.bwLimit),
+	}
 }
 
-func (r *Client) initialServerSync() (err error) {
-	progressLn("Initial file sync using rsync at " + r.settings.host + "...")
-
-	args := []string{"-e", "ssh " + strings.Join(sshOptions(r.settings), " ")}
-	for dir := range r.settings.excludes {
-		args = append(args, "--exclude="+dir)
+// isExcluded reports whether change must not be sent to the server because of its own rules:
+// out.log is shared by all servers and is written using only the general ones
+func (r *Client) isExcluded(file string, stat *UnrealStat) bool {
+	if r.settings.excludes.MatchChange(file, stat) {
+		return true
 	}
+	if reason := r.settings.excludes.SkipsStat(file, stat); reason != "" {
+		r.skipped.report(file+" for "+r.settings.host, reason)
+		return true
+	}
+	return false
+}
+
+// initialServerSync returns references to big files that were being sent before reconnect: they are
+// skipped by rsync and resumed by the big file lane instead, see resumeBigFiles
+func (r *Client) initialServerSync(unfinished []string) (resumed [][]byte, err error) {
+	progressLn("Initial file sync using rsync at " + r.settings.host + "...")
 
 	err = openOutLogForRead(r.settings.host, true)
 	if err != nil {
 		return
 	}
+
+	// stat is taken after the log was opened, so later changes of the file are sent anyway
+	var skip []string
+	for _, file := range unfinished {
+		info, err := os.Lstat(file)
+		if err != nil || !info.Mode().IsRegular() || info.Size() <= bigFileThreshold {
+			continue
+		}
+		stat := UnrealStatFromStat(file, info)
+		if !r.isExcluded(file, &stat) {
+			resumed = append(resumed, bigFilePayload(file, &stat))
+			skip = append(skip, file)
+		}
+	}
+
+	if err = r.rsync(skip); err != nil {
+		panic("Cannot perform initial sync")
+	}
+	r.setSynced(true)
+	return
+}
+
+// resumeBigFiles tells server which partially received big files to keep and queues them for sending
+func (r *Client) resumeBigFiles(queue chan []byte, resumed [][]byte) {
+	var remoteFiles []string
+	for _, ref := range resumed {
+		file, _ := parseBigFilePayload(ref)
+		if remoteFile, ok := r.remoteName(file); ok {
+			remoteFiles = append(remoteFiles, remoteFile)
+		}
+	}
+	r.sendToServer(actionBigKeep, []byte(strings.Join(remoteFiles, "\n")))
+
+	for _, ref := range resumed {
+		select {
+		case queue <- ref:
+		case <-r.stopCh:
+			panic("Stopped while queueing big files for " + r.settings.host)
+		}
+	}
+}
+
+// rsync copies the whole directory to the server, mapped subtrees are copied separately.
+// Files from skip are left as is on the server
+func (r *Client) rsync(skip []string) (err error) {
+	// rules of ignore files are known only after the local directory was scanned
+	select {
+	case <-repoReady:
+	case <-r.stopCh:
+		return errors.New("Stopped before rsync to " + r.settings.host)
+	}
+
+	var filters []string
+	for _, m := range r.settings.mappings {
+		filters = append(filters, "--exclude=/"+m.prefix)
+	}
+	for _, file := range skip {
+		filters = append(filters, "--exclude=/"+rsyncLiteral(file))
+	}
+	if err = r.rsyncDir(".", r.settings.excludes, filters, sourceDir, r.settings.dir); err != nil {
+		return
+	}
+
+	for _, m := range r.settings.mappings {
+		if !r.settings.excludes.Allows(m.prefix, true) || r.settings.excludes.Match(m.prefix, true) {
+			continue
+		}
+		progressLn("Initial sync of ", m.prefix, " to ", r.settings.host, ":", m.dir, "...")
+
+		// nested mappings are excluded from their parent
+		var filters []string
+		for _, other := range r.settings.mappings {
+			if strings.HasPrefix(other.prefix, m.prefix+"/") {
+				filters = append(filters, "--exclude=/"+other.prefix[len(m.prefix)+1:])
+			}
+		}
+		for _, file := range skip {
+			if strings.HasPrefix(file, m.prefix+"/") {
+				filters = append(filters, "--exclude=/"+rsyncLiteral(file[len(m.prefix)+1:]))
+			}
+		}
+		if err = r.rsyncDir(m.prefix, r.settings.excludes.Under(m.prefix), filters, filepath.Join(sourceDir, m.prefix), m.dir); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// rsyncDir copies subtree at root (relative to the synced directory) from source to dir at the server
+func (r *Client) rsyncDir(root string, excludes *Excludes, extraFilters []string, source, dir string) (err error) {
+	args := []string{"-e", "ssh " + strings.Join(sshOptions(r.settings), " ")}
+	// rsync uses the first matching rule, ignore files take precedence over excludes,
+	// includes go last because they exclude everything that is not included
+	args = append(args, extraFilters...)
+	args = append(args, repo.ignoreRsyncArgs(root)...)
+	args = append(args, excludes.RsyncArgs()...)
+
 	if r.settings.sudouser != "" {
 		args = append(args, "--rsync-path", "sudo -u "+r.settings.sudouser+" rsync")
 	}
 
+	if rate := r.bwLimit.getRate(); rate > 0 {
+		args = append(args, "--bwlimit="+rsyncBwLimit(rate))
+	}
+
+	if rsyncHasProgress2() {
+		args = append(args, "--info=progress2", "--no-inc-recursive")
+	}
+
 	//"--delete-excluded",
-	args = append(args, "-a", "--delete", sourceDir+"/", r.settings.host+":"+r.settings.dir+"/")
+	args = append(args, "-a", "--delete", source+"/", r.settings.host+":"+dir+"/")
 
 	command := exec.Command("rsync", args...)
+	var output, stderr bytes.Buffer
+	command.Stderr = &stderr
 
-	go killOnStop(command, r.stopCh)
-	output, err := command.Output()
+	stdout, err := command.StdoutPipe()
+	if err != nil {
+		return
+	}
+	if err = command.Start(); err == nil {
+		r.syncProgress.start("", 0, 0)
+		go killOnStop(command, r.stopCh)
+		r.readRsyncProgress(stdout, &output)
+		err = command.Wait()
+		r.syncProgress.finish()
+	}
 
 	if err != nil {
 		escapedArgs := make([]string, len(args))
@@ -53,19 +219,77 @@ func (r *Client) initialServerSync() (err error) {
 			escapedArgs[i] = "'" + arg + "'"
 		}
 		stringCommand := "rsync " + strings.Join(escapedArgs, " ")
-		progressLn("Cannot perform initial sync. Please ensure that you can execute the following command:\n", stringCommand)
+		progressLn("Cannot perform rsync. Please ensure that you can execute the following command:\n", stringCommand)
 
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			debugLn("rsync output:\n", string(output), "\nstderr:\n", string(exitErr.Stderr))
-		} else {
-			// actually, this is mostly impossible to have something different than exec.ExitError here
-			debugLn("rsync output:\n", string(output), "\nCannot get stderr!")
-		}
-		panic("Cannot perform initial sync")
+		debugLn("rsync output:\n", output.String(), "\nstderr:\n", stderr.String())
 	}
 	return
 }
 
+var (
+	rsyncProgress2Once sync.Once
+	rsyncProgress2     bool
+)
+
+// rsyncHasProgress2 checks whether local rsync supports --info=progress2 (rsync 3.1+)
+func rsyncHasProgress2() bool {
+	rsyncProgress2Once.Do(func() {
+		output, err := exec.Command("rsync", "--version").Output()
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(string(output))
+		for i, field := range fields {
+			if field == "version" && i+1 < len(fields) {
+				version, err := versionToIntArray(fields[i+1])
+				rsyncProgress2 = err == nil && len(version) >= 2 &&
+					(version[0] > 3 || version[0] == 3 && version[1] >= 1)
+				return
+			}
+		}
+	})
+	return rsyncProgress2
+}
+
+// readRsyncProgress parses lines like "  1,234,567  45%  12.34MB/s  0:00:23 (xfr#1, to-chk=5/10)"
+// that rsync prints with --info=progress2, everything else is kept in output
+func (r *Client) readRsyncProgress(stdout io.Reader, output *bytes.Buffer) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Split(func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+			return i + 1, data[0:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.HasSuffix(fields[1], "%") {
+			output.WriteString(line + "\n")
+			continue
+		}
+
+		done, err := strconv.ParseInt(strings.Replace(fields[0], ",", "", -1), 10, 64)
+		if err != nil {
+			continue
+		}
+		percent, err := strconv.ParseInt(strings.TrimSuffix(fields[1], "%"), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		var total int64
+		if percent > 0 {
+			total = done * 100 / percent
+		}
+		r.syncProgress.set(done, total)
+	}
+}
+
 func (r *Client) copyUnrealsyncBinaries(unrealsyncBinaryPathForHost string) {
 	progressLn("Copying unrealsync binary " + unrealsyncBinaryPathForHost + " to " + r.settings.host)
 	args := sshOptions(r.settings)
@@ -77,6 +301,11 @@ func (r *Client) copyUnrealsyncBinaries(unrealsyncBinaryPathForHost string) {
 func (r *Client) startServer() {
 	r.stopCh = make(chan bool)
 	r.errorCh = make(chan error)
+	r.setSynced(false)
+	// misses of the previous connection are fixed by the initial sync
+	r.takeCopyMisses()
+	unfinished := r.bigFiles.unfinished()
+	var resumed [][]byte
 	var cmd *exec.Cmd
 	var stdin io.WriteCloser
 	var stdout io.ReadCloser
@@ -112,7 +341,25 @@ func (r *Client) startServer() {
 		}
 	}()
 
-	r.initialServerSync()
+	reconcile := r.settings.reconcile
+	if r.skipInitialSync {
+		r.skipInitialSync = false
+		reconcile = false
+		progressLn("Skipping initial sync for " + r.settings.host + " as it was in sync with the index")
+		if err := openOutLogForRead(r.settings.host, false); err != nil {
+			panic(err)
+		}
+		r.setSynced(true)
+	} else if reconcile {
+		if err := openOutLogForRead(r.settings.host, true); err != nil {
+			panic(err)
+		}
+	} else {
+		var err error
+		if resumed, err = r.initialServerSync(unfinished); err != nil {
+			panic(err)
+		}
+	}
 	ostype, osarch, unrealsyncBinaryPath, unrealsyncVersion := r.createDirectoriesAt()
 	progressLn("Discovered ostype:" + ostype + " osarch:" + osarch + " binary:" + unrealsyncBinaryPath + " version:" + unrealsyncVersion + " at " + r.settings.host)
 	if r.settings.remoteBinPath != "" {
@@ -129,14 +376,26 @@ func (r *Client) startServer() {
 
 	cmd, stdin, stdout = r.launchUnrealsyncAt(unrealsyncBinaryPath)
 
-	stream := make(chan BufBlocker)
+	r.stream = make(chan BufBlocker)
+	r.treeCh = make(chan []byte, 1)
 	// receive from singlestdinwriter (stream) and send into ssh stdin
-	go singleStdinWriter(stream, stdin, r.errorCh, r.stopCh)
-	// read log and send into ssh stdin via singlestdinwriter (stream)
-	// stops if stopChan closes and closes stream
-	go doSendChanges(stream, r)
+	go singleStdinWriter(r.stream, stdin, r.bwLimit, r.errorCh, r.stopCh)
+	// send big files referenced in the log into ssh stdin via singlestdinwriter (stream)
+	bigQueue := r.bigFiles.reset(resumed)
+	go r.bigFileThread(bigQueue)
+	if len(resumed) > 0 {
+		r.resumeBigFiles(bigQueue, resumed)
+	}
+	if reconcile {
+		// compare hash trees and send the difference, then start sending log as below
+		go r.reconcileThread()
+	} else {
+		// read log and send into ssh stdin via singlestdinwriter (stream)
+		// stops if stopChan closes and closes stream
+		go doSendChanges(r.stream, r)
+	}
 	// read ssh stdout and send into ssh stdin via singlestdinwriter (stream)
-	go pingReplyThread(stdout, r.settings.host, stream, r.errorCh)
+	go r.pingReplyThread(stdout)
 
 	err := <-r.errorCh
 	panic(err)
@@ -151,8 +410,33 @@ func (r *Client) launchUnrealsyncAt(unrealsyncBinaryPath string) (*exec.Cmd, io.
 	if isDebug {
 		flags += " --debug"
 	}
-	for dir := range r.settings.excludes {
-		flags += " --exclude " + dir
+	if hashCheck {
+		flags += " --hash-check"
+	}
+	flags += " --hash=" + hashAlgo
+	if useGitignore {
+		flags += " --gitignore"
+	}
+	for _, pattern := range r.settings.excludes.Patterns() {
+		flags += " --exclude " + shellQuote(pattern)
+	}
+	for _, pattern := range r.settings.excludes.Includes() {
+		flags += " --include " + shellQuote(pattern)
+	}
+	for _, dir := range r.settings.excludes.Sparse() {
+		flags += " --sparse " + shellQuote(dir)
+	}
+	if r.settings.excludes.maxFileSize != 0 {
+		flags += " --max-file-size " + strconv.FormatInt(r.settings.excludes.maxFileSize, 10)
+	}
+	if r.settings.excludes.minFileSize != 0 {
+		flags += " --min-file-size " + strconv.FormatInt(r.settings.excludes.minFileSize, 10)
+	}
+	if skipTypes := r.settings.excludes.SkipTypes(); len(skipTypes) > 0 {
+		flags += " --skip-types " + shellQuote(strings.Join(skipTypes, "|"))
+	}
+	for _, m := range r.settings.mappings {
+		flags += " --map " + shellQuote(m.flag())
 	}
 
 	unrealsyncLaunchCmd := unrealsyncBinaryPath + " " + flags + " " + r.settings.dir
@@ -199,7 +483,7 @@ func (r *Client) createDirectoriesAt() (ostype, osarch, unrealsyncBinaryPath, un
 	return strings.ToLower(uname[0]), uname[1], uname[2], uname[3]
 }
 
-func singleStdinWriter(stream chan BufBlocker, stdin io.WriteCloser, errorCh chan error, stopCh chan bool) {
+func singleStdinWriter(stream chan BufBlocker, stdin io.WriteCloser, bwLimit *bwLimiter, errorCh chan error, stopCh chan bool) {
 	var bufBlocker BufBlocker
 	for {
 		select {
@@ -207,7 +491,7 @@ func singleStdinWriter(stream chan BufBlocker, stdin io.WriteCloser, errorCh cha
 		case <-stopCh:
 			break
 		}
-		_, err := stdin.Write(bufBlocker.buf)
+		err := bwLimit.write(stdin, bufBlocker.buf, stopCh)
 		if err != nil {
 			sendErrorNonBlocking(errorCh, err)
 			break
@@ -220,20 +504,21 @@ func singleStdinWriter(stream chan BufBlocker, stdin io.WriteCloser, errorCh cha
 	}
 }
 
-func pingReplyThread(stdout io.ReadCloser, hostname string, stream chan BufBlocker, errorCh chan error) {
+func (r *Client) pingReplyThread(stdout io.ReadCloser) {
+	hostname := r.settings.host
 	bufBlocker := BufBlocker{buf: make([]byte, 20), sent: make(chan bool)}
 	bufBlocker.buf = []byte(actionPong + fmt.Sprintf("%10d", 0))
 	buf := make([]byte, 10)
 	for {
 		readBytes, err := io.ReadFull(stdout, buf)
 		if err != nil {
-			sendErrorNonBlocking(errorCh, errors.New("Could not read from server: "+hostname+" err:"+err.Error()))
+			sendErrorNonBlocking(r.errorCh, errors.New("Could not read from server: "+hostname+" err:"+err.Error()))
 			break
 		}
 		actionStr := string(buf)
 		debugLn("Read ", readBytes, " from ", hostname, " ", buf)
 		if actionStr == actionPing {
-			stream <- bufBlocker
+			r.stream <- bufBlocker
 			<-bufBlocker.sent
 		} else if actionStr == actionStopServer {
 			currentProcess, err := os.FindProcess(os.Getpid())
@@ -242,8 +527,162 @@ func pingReplyThread(stdout io.ReadCloser, hostname string, stream chan BufBlock
 			}
 			progressLn("Got StopServer command from the remote client ", hostname)
 			currentProcess.Kill()
+		} else if actionStr == actionTreeReply {
+			payload, err := readPayload(stdout)
+			if err != nil {
+				sendErrorNonBlocking(r.errorCh, errors.New("Could not read tree from server: "+hostname+" err:"+err.Error()))
+				break
+			}
+			r.treeCh <- payload
+		} else if actionStr == actionBigHave {
+			payload, err := readPayload(stdout)
+			if err != nil {
+				sendErrorNonBlocking(r.errorCh, errors.New("Could not read big file offset from server: "+hostname+" err:"+err.Error()))
+				break
+			}
+			r.deliverBigOffset(payload)
+		} else if actionStr == actionCopyMiss {
+			payload, err := readPayload(stdout)
+			if err != nil {
+				sendErrorNonBlocking(r.errorCh, errors.New("Could not read copy miss from server: "+hostname+" err:"+err.Error()))
+				break
+			}
+			r.queueCopyMiss(string(payload))
+		}
+	}
+}
+
+// sendBigFile streams big file referenced in the log from the source file directly to the server
+func (r *Client) sendBigFile(ref []byte) (ok bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			progressLn("Sending big file to ", r.settings.host, " stopped: ", err)
+			ok = false
+		}
+	}()
+
+	file, stat := parseBigFilePayload(ref)
+	r.commitBigFile(file, &stat)
+	return true
+}
+
+// queueCopyMiss remembers file that server could not copy from another path. Such files are resent
+// by doSendChanges in between of log entries, so that resent contents do not overtake later changes
+func (r *Client) queueCopyMiss(file string) {
+	r.copyMissesMutex.Lock()
+	r.copyMisses = append(r.copyMisses, file)
+	r.copyMissesMutex.Unlock()
+
+	select {
+	case r.copyMissCh <- true:
+	default:
+		// misses are already waiting
+	}
+}
+
+func (r *Client) takeCopyMisses() []string {
+	r.copyMissesMutex.Lock()
+	defer r.copyMissesMutex.Unlock()
+
+	files := r.copyMisses
+	r.copyMisses = nil
+	return files
+}
+
+// resendCopyMisses sends current state of the files that server could not copy using one diff writer
+func (r *Client) resendCopyMisses() (ok bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			progressLn("Could not resend files to ", r.settings.host, ": ", err)
+			ok = false
+		}
+	}()
+
+	// current state of a file may be big
+	if !r.bigFiles.wait(func() bool { return !r.bigFiles.idle() }, r.stopCh) {
+		return false
+	}
+
+	paths := make(map[string]bool)
+	for _, file := range r.takeCopyMisses() {
+		paths[r.localName(file)] = true
+	}
+
+	diff := r.newDiffWriter()
+	for _, change := range currentState(paths) {
+		if !r.isExcluded(change.file, change.stat) {
+			debugLn("Resending ", change.file, " to ", r.settings.host)
+			diff.Add(change.file, change.stat)
+		}
+	}
+	diff.Commit()
+	return true
+}
+
+func (r *Client) expectBigOffset(file string) chan int64 {
+	r.bigOffsetsMutex.Lock()
+	defer r.bigOffsetsMutex.Unlock()
+
+	ch := make(chan int64, 1)
+	r.bigOffsets[file] = ch
+	return ch
+}
+
+func (r *Client) waitBigOffset(file string, ch chan int64) int64 {
+	defer func() {
+		r.bigOffsetsMutex.Lock()
+		if r.bigOffsets[file] == ch {
+			delete(r.bigOffsets, file)
 		}
+		r.bigOffsetsMutex.Unlock()
+	}()
+
+	select {
+	case offset := <-ch:
+		return offset
+	case <-r.stopCh:
+		panic("Stopped while waiting for big file offset from " + r.settings.host)
+	}
+}
+
+// deliverBigOffset passes actionBigHave: filename length (10 bytes) | filename | offset (20 bytes)
+func (r *Client) deliverBigOffset(payload []byte) {
+	filenameLen, err := strconv.Atoi(string(payload[0:10]))
+	if err != nil || len(payload) != 10+filenameLen+20 {
+		progressLn("Malformed big file offset from ", r.settings.host)
+		return
+	}
+	file := string(payload[10 : 10+filenameLen])
+	offset, err := strconv.ParseInt(string(payload[10+filenameLen:]), 10, 64)
+	if err != nil {
+		progressLn("Malformed big file offset from ", r.settings.host)
+		return
+	}
+
+	r.bigOffsetsMutex.Lock()
+	ch, ok := r.bigOffsets[file]
+	r.bigOffsetsMutex.Unlock()
+	if ok {
+		ch <- offset
+	}
+}
+
+func readPayload(stdout io.Reader) ([]byte, error) {
+	lengthBytes := make([]byte, 10)
+	if _, err := io.ReadFull(stdout, lengthBytes); err != nil {
+		return nil, err
+	}
+
+	length, err := strconv.Atoi(strings.TrimSpace(string(lengthBytes)))
+	if err != nil {
+		return nil, err
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(stdout, payload); err != nil {
+		return nil, err
 	}
+	return payload, nil
 }
 
 func (r *Client) notifySendQueueSize(sendQueueSize int64) (err error) {
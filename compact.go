@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// When server lags behind, its part of the log may contain lots of intermediate versions of the
+// same files. Once the part gets bigger than compact-queue-size we skip it and send only the current
+// state of every path that was changed there.
+
+const defaultCompactQueueSize = 64 * 1048576
+
+// compactQueue moves log reader of the client to the end of the log and sends the current state
+// of the paths changed by the skipped entries directly to the server
+func compactQueue(client *Client) (ok bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			progressLn("Compaction for ", client.settings.host, " stopped: ", err)
+			ok = false
+		}
+	}()
+
+	hostname := client.settings.host
+	// compacted changes may include big files that are being sent right now
+	if !client.bigFiles.wait(func() bool { return !client.bigFiles.idle() }, client.stopCh) {
+		return false
+	}
+
+	client.setSynced(false)
+	outLogMutex.Lock()
+	from := outLogReaders[hostname]
+	to := logCursor{outLogSegment, outLogPos}
+	pendingSize := pendingLogSize(from)
+	outLogMutex.Unlock()
+
+	progressLn("Compacting ", formatLength(int(pendingSize)), " of pending changes for ", hostname)
+
+	paths, err := collectLogPaths(from, to)
+	if err != nil {
+		panic(err)
+	}
+
+	outLogMutex.Lock()
+	err = openOutLogSegmentForRead(hostname, to)
+	outLogMutex.Unlock()
+	if err != nil {
+		panic(err)
+	}
+
+	changes := currentState(paths)
+	diff := client.newDiffWriter()
+	first, rest := prioritize(changes)
+	for _, batch := range [][]fileChange{first, rest} {
+		for _, change := range batch {
+			if !client.isExcluded(change.file, change.stat) {
+				diff.Add(change.file, change.stat)
+			}
+		}
+		diff.Commit()
+	}
+
+	progressLn("Sent ", len(changes), " compacted changes to ", hostname)
+	client.setSynced(true)
+	return true
+}
+
+// collectLogPaths returns paths that were changed by log entries between from and to
+func collectLogPaths(from, to logCursor) (map[string]bool, error) {
+	paths := make(map[string]bool)
+	buf := make([]byte, maxDiffSize+20)
+
+	for segment := from.segment; segment <= to.segment; segment++ {
+		var offset, end int64 = 0, to.offset
+		if segment == from.segment {
+			offset = from.offset
+		}
+		if segment != to.segment {
+			outLogMutex.Lock()
+			end = outLogSegmentSizes[segment]
+			outLogMutex.Unlock()
+		}
+
+		fp, err := os.Open(getLogSegmentPath(segment))
+		if err != nil {
+			return nil, err
+		}
+		if _, err = fp.Seek(offset, io.SeekStart); err != nil {
+			fp.Close()
+			return nil, err
+		}
+
+		for offset < end {
+			bufLen, err := readLogEntry(fp, buf)
+			if err != nil {
+				fp.Close()
+				return nil, err
+			}
+			offset += int64(bufLen)
+
+			action := string(buf[0:10])
+			if action == actionDiff {
+				forEachDiffEntry(buf[20:bufLen], func(entry diffEntry) {
+					paths[filepath.Clean(entry.file)] = true
+				})
+			} else if action == actionBigRef {
+				file, _ := parseBigFilePayload(buf[20:bufLen])
+				paths[filepath.Clean(file)] = true
+			}
+		}
+		fp.Close()
+	}
+
+	return paths, nil
+}
+
+// currentState returns changes that bring paths to their current state. Paths are sorted
+// so that directories are created before their contents
+func currentState(paths map[string]bool) []fileChange {
+	sorted := make([]string, 0, len(paths))
+	for file := range paths {
+		sorted = append(sorted, file)
+	}
+	sort.Strings(sorted)
+
+	repo.Lock()
+	defer repo.Unlock()
+
+	changes := make([]fileChange, 0, len(sorted))
+	for _, file := range sorted {
+		if stat, ok := repo.GetDirStat(filepath.Dir(file))[filepath.Base(file)]; ok {
+			statCopy := *stat
+			changes = append(changes, fileChange{file, &statCopy})
+		} else {
+			changes = append(changes, fileChange{file, nil})
+		}
+	}
+	return changes
+}
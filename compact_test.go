@@ -0,0 +1,75 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCollectLogPaths(t *testing.T) {
+	// small segments, so that entries are spread over several of them
+	initTestLog(t, 100)
+	// reader of the compacted host keeps the segments
+	if err := openOutLogForRead("host", false); err != nil {
+		t.Fatal(err)
+	}
+
+	stat := &UnrealStat{mode: 0644, mtime: 1, size: 3}
+	entries := []struct {
+		action  string
+		payload string
+	}{
+		{actionDiff, "A skipped\n" + stat.Serialize() + diffSep + "abc"},
+		{actionDiff, "A a/b\n" + stat.Serialize() + diffSep + "abc" + "D c" + diffSep},
+		{actionPing, ""},
+		{actionBigRef, string(bigFilePayload("big/./file", stat))},
+		{actionDiff, "C d\n" + stat.Serialize() + "\nhash a/b" + diffSep + "A a/b\n" + stat.Serialize() + diffSep + "xyz"},
+		{actionDiff, "D e/" + diffSep},
+	}
+
+	var from logCursor
+	for i, entry := range entries {
+		writeToOutLog(entry.action, []byte(entry.payload))
+		if i == 0 {
+			from = logCursor{outLogSegment, outLogPos}
+		}
+	}
+	if outLogSegment == 0 {
+		t.Fatalf("log has a single segment")
+	}
+
+	got, err := collectLogPaths(from, logCursor{outLogSegment, outLogPos})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{"a/b": true, "c": true, "big/file": true, "d": true, "e": true}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("collectLogPaths() = %v, want %v", got, want)
+	}
+}
+
+func TestCurrentState(t *testing.T) {
+	oldRepo := repo
+	defer func() { repo = oldRepo }()
+
+	repo = NewRepository(NewExcludes())
+	repo.stats["."] = map[string]*UnrealStat{"a": {isDir: true, mode: 0755}, "b": {mode: 0644, size: 1}}
+	repo.stats["a"] = map[string]*UnrealStat{"c": {mode: 0644, size: 2}}
+
+	got := currentState(map[string]bool{"a/c": true, "b": true, "a": true, "gone": true, "a/gone": true})
+	want := []fileChange{
+		{"a", &UnrealStat{isDir: true, mode: 0755}},
+		{"a/c", &UnrealStat{mode: 0644, size: 2}},
+		{"a/gone", nil},
+		{"b", &UnrealStat{mode: 0644, size: 1}},
+		{"gone", nil},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("currentState() = %v, want %v", got, want)
+	}
+
+	// changes do not share stats with the repository
+	got[0].stat.mode = 0700
+	if repo.stats["."]["a"].mode != 0755 {
+		t.Errorf("currentState() returned stat of the repository")
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Diff is a sequence of entries, each of them is a header followed by contents of the file (if any):
+// "A file\nstat" + diffSep + contents for added files, dirs and symlinks,
+// "C file\nstat\nhash source" + diffSep for copies of existing files (see DiffWriter.addCopy),
+// "D file" + diffSep for deleted files.
+// Diffs are read as a stream, so contents of files never have to be in memory as a whole.
+
+type diffEntry struct {
+	op   byte
+	file string
+	stat UnrealStat
+	ref  string // "hash source" for copies
+}
+
+type diffReader struct {
+	r        *bufio.Reader
+	contents *io.LimitedReader
+}
+
+func newDiffReader(r io.Reader) *diffReader {
+	return &diffReader{r: bufio.NewReader(r)}
+}
+
+// Next returns next entry and reader for its contents. Contents that were not read are skipped
+// by the next call. Returns io.EOF when there are no more entries
+func (d *diffReader) Next() (entry diffEntry, contents io.Reader, err error) {
+	if d.contents != nil && d.contents.N > 0 {
+		if _, err = io.Copy(ioutil.Discard, d.contents); err != nil {
+			return
+		}
+	}
+	d.contents = nil
+
+	var lines []string
+	for {
+		var line string
+		line, err = d.r.ReadString('\n')
+		if err == io.EOF && line == "" && len(lines) == 0 {
+			return
+		} else if err != nil {
+			err = errors.New("Unexpected end of diff")
+			return
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		if "\n"+line+"\n" == diffSep {
+			break
+		}
+		lines = append(lines, line)
+	}
+
+	if len(lines) == 0 || len(lines[0]) < 2 {
+		err = errors.New("Malformed diff entry: " + strings.Join(lines, "\n"))
+		return
+	}
+
+	entry.op = lines[0][0]
+	entry.file = lines[0][2:]
+
+	switch {
+	case entry.op == 'A' && len(lines) == 2:
+		entry.stat = UnrealStatUnserialize(lines[1])
+		if !entry.stat.isDir && entry.stat.size > 0 {
+			d.contents = &io.LimitedReader{R: d.r, N: entry.stat.size}
+			contents = d.contents
+		}
+	case entry.op == 'C' && len(lines) == 3:
+		entry.stat = UnrealStatUnserialize(lines[1])
+		entry.ref = lines[2]
+	case entry.op == 'D' && len(lines) == 1:
+	default:
+		err = errors.New("Malformed diff entry: " + strings.Join(lines, "\n"))
+		return
+	}
+
+	if contents == nil {
+		contents = bytes.NewReader(nil)
+	}
+	return
+}
+
+// filterDiff returns diff with only the entries for which keep returns true, keep may also change
+// file and ref of the entry. buf itself is returned if all entries are kept unchanged
+func filterDiff(buf []byte, keep func(entry *diffEntry) bool) []byte {
+	var result []byte
+	filtered := false
+
+	for pos := 0; pos < len(buf); {
+		headerLen := bytes.Index(buf[pos:], []byte(diffSep))
+		if headerLen < 0 {
+			fatalLn("Malformed diff entry: ", string(buf[pos:]))
+		}
+		end := pos + headerLen + len(diffSep)
+
+		entry, _, err := newDiffReader(bytes.NewReader(buf[pos:end])).Next()
+		if err != nil {
+			fatalLn(err)
+		}
+		if entry.op == 'A' && !entry.stat.isDir {
+			end += int(entry.stat.size)
+		}
+
+		file, ref := entry.file, entry.ref
+		if !keep(&entry) {
+			filtered = true
+		} else if entry.file != file || entry.ref != ref {
+			lines := strings.Split(string(buf[pos:pos+headerLen]), "\n")
+			lines[0] = string(entry.op) + " " + entry.file
+			if entry.op == 'C' {
+				lines[2] = entry.ref
+			}
+			result = append(append(result, strings.Join(lines, "\n")+diffSep...), buf[pos+headerLen+len(diffSep):end]...)
+			filtered = true
+		} else {
+			result = append(result, buf[pos:end]...)
+		}
+		pos = end
+	}
+
+	if !filtered {
+		return buf
+	}
+	return result
+}
+
+// forEachDiffEntry calls fn for every entry of the diff, contents of files are skipped
+func forEachDiffEntry(buf []byte, fn func(entry diffEntry)) {
+	diff := newDiffReader(bytes.NewReader(buf))
+	for {
+		entry, _, err := diff.Next()
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			fatalLn(err)
+		}
+		fn(entry)
+	}
+}
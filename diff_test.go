@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeTestDiff puts files of the current directory into a diff, nil stat is a deletion
+func writeTestDiff(t *testing.T, files []string) (diff []byte, stats map[string]*UnrealStat) {
+	stats = make(map[string]*UnrealStat)
+	d := &DiffWriter{write: func(action string, buf []byte) { diff = append(diff, buf...) }}
+	for _, file := range files {
+		info, err := os.Lstat(file)
+		if os.IsNotExist(err) {
+			d.Add(file, nil)
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		stat := UnrealStatFromStat(file, info)
+		stats[file] = &stat
+		d.Add(file, &stat)
+	}
+	d.Commit()
+	return
+}
+
+func TestDiffReaderRoundTrip(t *testing.T) {
+	chdirTemp(t)
+	if err := os.Mkdir("dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	contents := map[string]string{"dir/a.txt": "first\n" + diffSep + "file", "empty": "", "link": "dir/a.txt"}
+	for _, file := range []string{"dir/a.txt", "empty"} {
+		if err := ioutil.WriteFile(file, []byte(contents[file]), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("dir/a.txt", "link"); err != nil {
+		t.Fatal(err)
+	}
+
+	files := []string{"dir", "dir/a.txt", "empty", "link", "gone"}
+	diff, stats := writeTestDiff(t, files)
+	// copies are written only with repo, so the entry is added by hand
+	diff = append(diff, "C dir/b.txt\n"+stats["dir/a.txt"].Serialize()+"\nhash dir/a.txt"+diffSep...)
+	files = append(files, "dir/b.txt")
+
+	for _, readContents := range []bool{true, false} {
+		reader := newDiffReader(bytes.NewReader(diff))
+		for _, file := range files {
+			entry, fileContents, err := reader.Next()
+			if err != nil {
+				t.Fatalf("Next() for %s: %v", file, err)
+			}
+			if entry.file != file {
+				t.Fatalf("Next() = %q, want %q", entry.file, file)
+			}
+
+			wantOp, wantRef := byte('A'), ""
+			if file == "gone" {
+				wantOp = 'D'
+			} else if file == "dir/b.txt" {
+				wantOp, wantRef = 'C', "hash dir/a.txt"
+			}
+			if entry.op != wantOp || entry.ref != wantRef {
+				t.Errorf("%s: op %c ref %q, want %c %q", file, entry.op, entry.ref, wantOp, wantRef)
+			}
+			if stat := stats[file]; wantOp == 'A' && entry.stat.Serialize() != stat.Serialize() {
+				t.Errorf("%s: stat %q, want %q", file, entry.stat.Serialize(), stat.Serialize())
+			}
+
+			if !readContents {
+				continue
+			}
+			got, err := ioutil.ReadAll(fileContents)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != contents[file] {
+				t.Errorf("%s: contents %q, want %q", file, got, contents[file])
+			}
+		}
+
+		if _, _, err := reader.Next(); err != io.EOF {
+			t.Errorf("Next() at the end = %v, want EOF", err)
+		}
+	}
+}
+
+func TestDiffReaderMalformed(t *testing.T) {
+	tests := []string{
+		"A file",
+		"X file" + diffSep,
+		"D file\nextra" + diffSep,
+		"C file\nmode=644 mtime=1 size=10" + diffSep,
+		diffSep,
+	}
+
+	for _, diff := range tests {
+		if entry, _, err := newDiffReader(strings.NewReader(diff)).Next(); err == nil || err == io.EOF {
+			t.Errorf("%q: read %c %s without error", diff, entry.op, entry.file)
+		}
+	}
+}
+
+func TestFilterDiff(t *testing.T) {
+	diff := []byte("A a\nmode=644 mtime=1 size=3" + diffSep + "abc" +
+		"D b" + diffSep +
+		"C c\nmode=644 mtime=1 size=3\nhash a" + diffSep +
+		"A d\ndir mode=755 mtime=1 size=0" + diffSep)
+
+	tests := []struct {
+		name string
+		keep func(entry *diffEntry) bool
+		want string
+	}{
+		{"all", func(entry *diffEntry) bool { return true }, string(diff)},
+		{"none", func(entry *diffEntry) bool { return false }, ""},
+		{"no deletions", func(entry *diffEntry) bool { return entry.op != 'D' },
+			"A a\nmode=644 mtime=1 size=3" + diffSep + "abc" +
+				"C c\nmode=644 mtime=1 size=3\nhash a" + diffSep +
+				"A d\ndir mode=755 mtime=1 size=0" + diffSep},
+		{"renamed", func(entry *diffEntry) bool {
+			entry.file = "x/" + entry.file
+			if entry.op == 'C' {
+				entry.ref = "hash x/a"
+			}
+			return entry.file != "x/d"
+		},
+			"A x/a\nmode=644 mtime=1 size=3" + diffSep + "abc" +
+				"D x/b" + diffSep +
+				"C x/c\nmode=644 mtime=1 size=3\nhash x/a" + diffSep},
+	}
+
+	for _, test := range tests {
+		if got := filterDiff(diff, test.keep); string(got) != test.want {
+			t.Errorf("%s: filterDiff() = %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	// diff itself is returned when nothing was changed
+	if got := filterDiff(diff, func(entry *diffEntry) bool { return true }); &got[0] != &diff[0] {
+		t.Errorf("filterDiff() copied the diff that was not changed")
+	}
+}
+
+func TestForEachDiffEntry(t *testing.T) {
+	diff := []byte("A a\nmode=644 mtime=1 size=3" + diffSep + "abc" + "D b" + diffSep + "A c\nsymlink mode=777 mtime=1 size=1" + diffSep + "a")
+
+	var got []string
+	forEachDiffEntry(diff, func(entry diffEntry) { got = append(got, string(entry.op)+" "+entry.file) })
+
+	want := []string{"A a", "D b", "A c"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("forEachDiffEntry() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Excludes are patterns with gitignore semantics:
+//
+//	foo      matches file or directory foo at any level
+//	/foo     matches foo only in the root of the synced directory
+//	foo/bar  patterns with slash in the beginning or in the middle are relative to the root
+//	foo/     matches only directories
+//	*, ?     match anything except slash, [a-z] matches a character from the range
+//	**       matches any number of directories: **/foo, foo/**, foo/**/bar
+//	         in other places ** is the same as *: foo**bar does not match foo/bar
+//	!foo     includes back what was excluded by previous patterns
+//
+// The last matching pattern wins. Nothing inside of an excluded directory can be included back.
+// Excludes also hold include patterns and sparse paths, see SetIncludes and SetSparse.
+type Excludes struct {
+	patterns []string
+	rules    []excludeRule
+
+	includePatterns []string
+	includes        []includeRule
+
+	sparse []string
+
+	// see Skips
+	minFileSize int64
+	maxFileSize int64
+	skipTypes   []string
+}
+
+type excludeRule struct {
+	negate   bool
+	dirOnly  bool
+	anchored bool
+	re       *regexp.Regexp
+}
+
+func NewExcludes(patterns ...string) *Excludes {
+	e := &Excludes{}
+	e.Add(patterns...)
+	return e
+}
+
+// Add appends patterns, empty patterns and comments are skipped
+func (e *Excludes) Add(patterns ...string) {
+	for _, pattern := range patterns {
+		if rule, ok := compileExcludeRule(pattern); ok {
+			e.patterns = append(e.patterns, pattern)
+			e.rules = append(e.rules, rule)
+		}
+	}
+}
+
+// Copy returns excludes that can be extended without changing e
+func (e *Excludes) Copy() *Excludes {
+	return &Excludes{
+		patterns:        append([]string(nil), e.patterns...),
+		rules:           append([]excludeRule(nil), e.rules...),
+		includePatterns: append([]string(nil), e.includePatterns...),
+		includes:        append([]includeRule(nil), e.includes...),
+		sparse:          append([]string(nil), e.sparse...),
+		minFileSize:     e.minFileSize,
+		maxFileSize:     e.maxFileSize,
+		skipTypes:       append([]string(nil), e.skipTypes...),
+	}
+}
+
+func (e *Excludes) Patterns() []string {
+	return e.patterns
+}
+
+func (e *Excludes) String() string {
+	result := strings.Join(e.patterns, "|")
+	if len(e.includePatterns) > 0 {
+		result += " include " + strings.Join(e.includePatterns, "|")
+	}
+	if len(e.sparse) > 0 {
+		result += " sparse " + strings.Join(e.sparse, "|")
+	}
+	if e.minFileSize != 0 || e.maxFileSize != 0 || len(e.skipTypes) > 0 {
+		result += fmt.Sprintf(" skip %d-%d %s", e.minFileSize, e.maxFileSize, strings.Join(e.skipTypes, "|"))
+	}
+	return result
+}
+
+// Match reports whether path is not included or is excluded either by itself or because
+// one of its parent directories is excluded
+func (e *Excludes) Match(path string, isDir bool) bool {
+	if !e.Allows(path, isDir) {
+		return true
+	}
+	for i := 0; i < len(path); i++ {
+		if path[i] == '/' {
+			if excluded, _ := e.match(path[:i], true); excluded {
+				return true
+			}
+		}
+	}
+	excluded, _ := e.match(path, isDir)
+	return excluded
+}
+
+// MatchChange is Match for a change of file, nil stat means deletion of a file or a directory.
+// Deletion is skipped if either of them is excluded, so that files that are not synced are never deleted
+func (e *Excludes) MatchChange(file string, stat *UnrealStat) bool {
+	if stat == nil {
+		return e.Match(file, false) || e.Match(file, true)
+	}
+	return e.Match(file, stat.isDir)
+}
+
+// match checks path itself without its parent directories, matched is false if no pattern matches it
+func (e *Excludes) match(path string, isDir bool) (excluded, matched bool) {
+	if e == nil {
+		return false, false
+	}
+	for _, rule := range e.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.re.MatchString(path) {
+			excluded, matched = !rule.negate, true
+		}
+	}
+	return excluded, matched
+}
+
+// RsyncArgs returns rsync filter arguments with the same meaning: rsync uses the first matching
+// rule instead of the last one, so rules are reversed and negations become includes
+func (e *Excludes) RsyncArgs() []string {
+	// skipped files can not be included back by patterns
+	args := append(e.sparseRsyncArgs(), e.skipRsyncArgs()...)
+	for i := len(e.patterns) - 1; i >= 0; i-- {
+		pattern, rule := e.patterns[i], e.rules[i]
+
+		option := "--exclude="
+		if rule.negate {
+			option = "--include="
+			pattern = pattern[1:]
+		}
+		if strings.HasPrefix(pattern, "\\") {
+			pattern = pattern[1:]
+		}
+		pattern = rsyncAsterisks(pattern)
+		// rsync matches patterns with a slash in the middle against the end of the path
+		if rule.anchored && !strings.HasPrefix(pattern, "/") {
+			pattern = "/" + pattern
+		}
+		args = append(args, option+pattern)
+	}
+	return append(args, e.includeRsyncArgs()...)
+}
+
+func compileExcludeRule(pattern string) (rule excludeRule, ok bool) {
+	pattern = strings.TrimRight(pattern, " ")
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return
+	}
+
+	if strings.HasPrefix(pattern, "!") {
+		rule.negate = true
+		pattern = pattern[1:]
+	} else if strings.HasPrefix(pattern, "\\!") || strings.HasPrefix(pattern, "\\#") {
+		pattern = pattern[1:]
+	}
+
+	if strings.HasSuffix(pattern, "/") {
+		rule.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	if pattern == "" {
+		return
+	}
+
+	if strings.HasPrefix(pattern, "/") {
+		rule.anchored = true
+		pattern = pattern[1:]
+	} else if strings.Contains(pattern, "/") {
+		rule.anchored = true
+	}
+
+	expr := globToRegexp(pattern)
+	if !rule.anchored {
+		expr = "(.*/)?" + expr
+	}
+
+	re, err := regexp.Compile("^" + expr + "$")
+	if err != nil {
+		progressLn("Invalid exclude pattern ", pattern, ": ", err)
+		return
+	}
+	rule.re = re
+	return rule, true
+}
+
+func globToRegexp(pattern string) string {
+	var expr strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "/**") && i+3 == len(pattern):
+			// trailing /** matches everything inside
+			expr.WriteString("/.*")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**/") && (i == 0 || pattern[i-1] == '/'):
+			// leading or middle **/ matches zero or more directories
+			expr.WriteString("(.*/)?")
+			i += 2
+		case pattern == "**":
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			// other consecutive asterisks are the same as a single one
+			for i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+			}
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				expr.WriteString(regexp.QuoteMeta(string(c)))
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + strings.Replace(class, "/", "", -1) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(pattern):
+			expr.WriteString(regexp.QuoteMeta(string(pattern[i+1])))
+			i++
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return expr.String()
+}
+
+// rsyncLiteral escapes file name for rsync pattern: backslashes are special only if there are wildcards
+func rsyncLiteral(name string) string {
+	if !strings.ContainsAny(name, "*?[") {
+		return name
+	}
+	return rsyncEscape(name)
+}
+
+// rsyncEscape escapes wildcards and backslashes for rsync pattern that has wildcards
+func rsyncEscape(name string) string {
+	var result strings.Builder
+	for _, c := range name {
+		if strings.ContainsRune("*?[\\", c) {
+			result.WriteByte('\\')
+		}
+		result.WriteRune(c)
+	}
+	return result.String()
+}
+
+// rsyncAsterisks replaces ** that is not a whole path component with *: rsync matches slashes with it
+func rsyncAsterisks(pattern string) string {
+	var result strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] == '\\' && i+1 < len(pattern) {
+			result.WriteString(pattern[i : i+2])
+			i++
+			continue
+		}
+		if !strings.HasPrefix(pattern[i:], "**") {
+			result.WriteByte(pattern[i])
+			continue
+		}
+
+		end := i
+		for end < len(pattern) && pattern[end] == '*' {
+			end++
+		}
+		if (i == 0 || pattern[i-1] == '/') && (end == len(pattern) || pattern[end] == '/') {
+			result.WriteString("**")
+		} else {
+			result.WriteString("*")
+		}
+		i = end - 1
+	}
+	return result.String()
+}
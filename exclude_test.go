@@ -0,0 +1,97 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExcludesMatch(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		path     string
+		isDir    bool
+		want     bool
+	}{
+		// not anchored patterns match at any level
+		{[]string{"foo"}, "foo", false, true},
+		{[]string{"foo"}, "a/b/foo", false, true},
+		{[]string{"foo"}, "a/foo/bar", false, true},
+		{[]string{"foo"}, "foobar", false, false},
+		{[]string{"*.log"}, "a/b.log", false, true},
+		{[]string{"?.txt"}, "ab.txt", false, false},
+		{[]string{"[a-c].txt"}, "b.txt", false, true},
+		{[]string{"[!a-c].txt"}, "b.txt", false, false},
+
+		// leading slash or slash in the middle anchor pattern to the root
+		{[]string{"/foo"}, "foo", false, true},
+		{[]string{"/foo"}, "a/foo", false, false},
+		{[]string{"a/foo"}, "a/foo", false, true},
+		{[]string{"a/foo"}, "b/a/foo", false, false},
+		{[]string{"a/*.go"}, "a/b/c.go", false, false},
+
+		// **
+		{[]string{"**/foo"}, "foo", false, true},
+		{[]string{"**/foo"}, "a/b/foo", false, true},
+		{[]string{"foo/**"}, "foo/a/b", false, true},
+		{[]string{"foo/**"}, "foo", true, false},
+		{[]string{"a/**/b"}, "a/b", false, true},
+		{[]string{"a/**/b"}, "a/x/y/b", false, true},
+		{[]string{"**"}, "a/b", false, true},
+		{[]string{"foo**bar"}, "foobazbar", false, true},
+		{[]string{"foo**bar"}, "foo/bar", false, false},
+		{[]string{"foo**bar"}, "foo/x/bar", false, false},
+		{[]string{"/a**/b"}, "a/x/b", false, false},
+		{[]string{"/a**/b"}, "ax/b", false, true},
+
+		// dir-only rules
+		{[]string{"build/"}, "build", true, true},
+		{[]string{"build/"}, "build", false, false},
+		{[]string{"build/"}, "a/build/x.o", false, true},
+
+		// negation, the last matching pattern wins
+		{[]string{"*.log", "!keep.log"}, "keep.log", false, false},
+		{[]string{"!keep.log", "*.log"}, "keep.log", false, true},
+		{[]string{"logs/", "!logs/keep.log"}, "logs/keep.log", false, true},
+
+		// escaping and comments
+		{[]string{"\\!foo"}, "!foo", false, true},
+		{[]string{"\\#foo"}, "#foo", false, true},
+		{[]string{"#foo"}, "#foo", false, false},
+		{[]string{"\\*"}, "x", false, false},
+		{[]string{"\\*"}, "*", false, true},
+		{[]string{"foo   "}, "foo", false, true},
+	}
+
+	for _, test := range tests {
+		if got := NewExcludes(test.patterns...).Match(test.path, test.isDir); got != test.want {
+			t.Errorf("%q.Match(%q, %v) = %v, want %v", test.patterns, test.path, test.isDir, got, test.want)
+		}
+	}
+}
+
+func TestExcludesPatterns(t *testing.T) {
+	patterns := NewExcludes("", "# comment", "foo", "/", "!bar").Patterns()
+	if want := []string{"foo", "!bar"}; !reflect.DeepEqual(patterns, want) {
+		t.Errorf("Patterns() = %q, want %q", patterns, want)
+	}
+}
+
+func TestExcludesRsyncArgs(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		want     []string
+	}{
+		{[]string{"foo", "!bar"}, []string{"--include=bar", "--exclude=foo"}},
+		{[]string{"a/b", "/c/"}, []string{"--exclude=/c/", "--exclude=/a/b"}},
+		{[]string{"\\#foo"}, []string{"--exclude=#foo"}},
+		{[]string{"**/foo", "foo/**"}, []string{"--exclude=/foo/**", "--exclude=/**/foo"}},
+		{[]string{"foo**bar"}, []string{"--exclude=foo*bar"}},
+		{[]string{"foo\\**"}, []string{"--exclude=foo\\**"}},
+	}
+
+	for _, test := range tests {
+		if got := NewExcludes(test.patterns...).RsyncArgs(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q.RsyncArgs() = %q, want %q", test.patterns, got, test.want)
+		}
+	}
+}
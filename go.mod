@@ -1,7 +1,16 @@
 module github.com/unrealsync/unrealsync
 
+go 1.22
+
 require (
 	github.com/glacjay/goini v0.0.0-20161120062552-fd3024d87ee2
 	github.com/ryanuber/go-glob v0.0.0-20170128012129-256dc444b735
 	github.com/unrealsync/fswatcher v0.0.0-20181203100244-53f7a0c2c947
+	github.com/zeebo/xxh3 v1.1.0
+	golang.org/x/text v0.21.0
+)
+
+require (
+	github.com/klauspost/cpuid/v2 v2.2.10 // indirect
+	golang.org/x/sys v0.30.0 // indirect
 )
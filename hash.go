@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/zeebo/xxh3"
+)
+
+// Contents of files are hashed with the algorithm selected by --hash (or "hash" in general settings),
+// client passes it to servers. Digests are encoded as "<algorithm>:<hex>", so that digests made by
+// different algorithms never match, e.g. when the index was saved with another algorithm.
+
+const defaultHashAlgo = "xxh3"
+
+var hashAlgos = map[string]func() hash.Hash{
+	"xxh3":   newXxh3,
+	"md5":    md5.New,
+	"sha256": sha256.New,
+}
+
+var hashAlgo = defaultHashAlgo
+
+// xxh3Hash is 128-bit variant of xxh3, 64 bits are too few to find copies by contents
+type xxh3Hash struct {
+	*xxh3.Hasher
+}
+
+func newXxh3() hash.Hash {
+	return xxh3Hash{xxh3.New()}
+}
+
+func (h xxh3Hash) Size() int {
+	return 16
+}
+
+func (h xxh3Hash) Sum(b []byte) []byte {
+	sum := h.Sum128().Bytes()
+	return append(b, sum[:]...)
+}
+
+func hashAlgoNames() string {
+	names := make([]string, 0, len(hashAlgos))
+	for name := range hashAlgos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// setHashAlgo selects hashing algorithm, source is used in the error message
+func setHashAlgo(name string, source string) {
+	if _, ok := hashAlgos[name]; !ok {
+		fatalLn("Unknown hash algorithm '", name, "' in ", source, ", supported are: ", hashAlgoNames())
+	}
+	hashAlgo = name
+}
+
+func newHash() hash.Hash {
+	return hashAlgos[hashAlgo]()
+}
+
+func encodeHash(h hash.Hash) string {
+	return hashAlgo + ":" + hex.EncodeToString(h.Sum(nil))
+}
+
+// isCurrentHash reports whether digest was made by the current algorithm
+func isCurrentHash(digest string) bool {
+	return strings.HasPrefix(digest, hashAlgo+":")
+}
+
+func computeHash(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := newHash()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+
+	return encodeHash(h), nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Ignore files contain exclude patterns (see Excludes) relative to the directory they are in.
+// .unrealsyncignore is always read, .gitignore only with --gitignore (or "gitignore" in general settings).
+// As in git, patterns from deeper files take precedence, and .unrealsyncignore takes precedence over
+// .gitignore in the same directory. Files are re-read on every sync of their directory, so changes apply live.
+
+const (
+	unrealsyncIgnoreFile = ".unrealsyncignore"
+	gitIgnoreFile        = ".gitignore"
+)
+
+var useGitignore = false
+
+// ignoreFileNames returns names of ignore files in the order of increasing precedence
+func ignoreFileNames() []string {
+	if useGitignore {
+		return []string{gitIgnoreFile, unrealsyncIgnoreFile}
+	}
+	return []string{unrealsyncIgnoreFile}
+}
+
+// ignoreRsyncArgs translates rules of ignore files into rsync filters for the subtree at root.
+// Rsync uses the first matching rule, so files go in the order of decreasing precedence: deeper first.
+// Ignore files of the parents of root apply to it too (see Excludes.Under), e.g. for mappings
+func (r *Repository) ignoreRsyncArgs(root string) []string {
+	r.ignoresMutex.RLock()
+	defer r.ignoresMutex.RUnlock()
+
+	dirs := make([]string, 0, len(r.ignores))
+	for dir := range r.ignores {
+		dirs = append(dirs, dir)
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		if di, dj := dirDepth(dirs[i]), dirDepth(dirs[j]); di != dj {
+			return di > dj
+		}
+		return dirs[i] < dirs[j]
+	})
+
+	var args []string
+	for _, dir := range dirs {
+		ignores, prefix := r.ignores[dir], ""
+		switch {
+		case root == "." && dir != ".":
+			prefix = dir
+		case dir == root:
+		case strings.HasPrefix(dir, root+"/"):
+			prefix = dir[len(root)+1:]
+		case dir == ".":
+			ignores = ignores.Under(root)
+		case strings.HasPrefix(root, dir+"/"):
+			ignores = ignores.Under(root[len(dir)+1:])
+		default:
+			continue
+		}
+		for _, arg := range ignores.RsyncArgs() {
+			args = append(args, rsyncFilterUnder(arg, prefix)...)
+		}
+	}
+	return args
+}
+
+func dirDepth(dir string) int {
+	if dir == "." {
+		return 0
+	}
+	return strings.Count(dir, "/") + 1
+}
+
+// rsyncFilterUnder makes filter from --exclude=pattern or --include=pattern apply only below dir
+func rsyncFilterUnder(arg string, dir string) []string {
+	if dir == "" {
+		return []string{arg}
+	}
+	eq := strings.Index(arg, "=")
+	option, pattern := arg[:eq+1], arg[eq+1:]
+	if strings.ContainsAny(pattern, "*?[") {
+		dir = rsyncEscape(dir)
+	} else {
+		dir = rsyncLiteral(dir)
+	}
+	if strings.HasPrefix(pattern, "/") {
+		return []string{option + "/" + dir + pattern}
+	}
+	// not anchored pattern matches at any level below dir, "**/" may not match zero directories
+	return []string{option + "/" + dir + "/" + pattern, option + "/" + dir + "/**/" + pattern}
+}
+
+func readIgnoreFile(path string) ([]string, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		patterns = append(patterns, strings.TrimRight(scanner.Text(), "\r"))
+	}
+	return patterns, scanner.Err()
+}
+
+// LoadIgnoreFiles (re)reads ignore files of dir and reports whether its rules have changed
+func (r *Repository) LoadIgnoreFiles(dir string) bool {
+	ignores := NewExcludes()
+	for _, name := range ignoreFileNames() {
+		patterns, err := readIgnoreFile(filepath.Join(dir, name))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				progressLn("Cannot read ", filepath.Join(dir, name), ": ", err)
+			}
+			continue
+		}
+		ignores.Add(patterns...)
+	}
+
+	r.ignoresMutex.Lock()
+	defer r.ignoresMutex.Unlock()
+
+	old, ok := r.ignores[dir]
+	if len(ignores.Patterns()) == 0 {
+		delete(r.ignores, dir)
+		return ok
+	}
+	r.ignores[dir] = ignores
+	return !ok || strings.Join(old.Patterns(), "\n") != strings.Join(ignores.Patterns(), "\n")
+}
+
+// isIgnored checks path itself against ignore files of its parent directories
+func (r *Repository) isIgnored(path string, isDir bool, excluded bool) bool {
+	r.ignoresMutex.RLock()
+	defer r.ignoresMutex.RUnlock()
+
+	if len(r.ignores) == 0 {
+		return excluded
+	}
+
+	// from the root down, so that deeper files take precedence
+	for i := -1; i < len(path); i++ {
+		if i >= 0 && path[i] != '/' {
+			continue
+		}
+		dir, rel := ".", path
+		if i >= 0 {
+			dir, rel = path[:i], path[i+1:]
+		}
+		if ignores, ok := r.ignores[dir]; ok {
+			if ignored, matched := ignores.match(rel, isDir); matched {
+				excluded = ignored
+			}
+		}
+	}
+	return excluded
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIgnoreRsyncArgs(t *testing.T) {
+	r := &Repository{ignores: map[string]*Excludes{
+		".":       NewExcludes("*.log", "/build", "!keep.log"),
+		"src":     NewExcludes("tmp/", "!/gen/x*.c"),
+		"src/lib": NewExcludes("*.o"),
+	}}
+
+	tests := []struct {
+		root string
+		want []string
+	}{
+		{".", []string{
+			"--exclude=/src/lib/*.o", "--exclude=/src/lib/**/*.o",
+			"--include=/src/gen/x*.c", "--exclude=/src/tmp/", "--exclude=/src/**/tmp/",
+			"--include=keep.log", "--exclude=/build", "--exclude=*.log",
+		}},
+		// mappings get rules of the ignore files above them
+		{"src/lib", []string{"--exclude=*.o", "--exclude=tmp/", "--include=keep.log", "--exclude=*.log"}},
+		{"docs", []string{"--include=keep.log", "--exclude=*.log"}},
+	}
+
+	for _, test := range tests {
+		if got := r.ignoreRsyncArgs(test.root); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ignoreRsyncArgs(%q) = %q, want %q", test.root, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// Include patterns limit sync to the matching paths, everything inside of them and the parent
+// directories they need. They use the same syntax as excludes, but are always relative to the root
+// of the synced directory: "config" is ./config, use "**/config" to match config at any level.
+// Excludes are applied on top of includes.
+
+type includeRule struct {
+	excludeRule
+	pattern  string
+	segments []string // pattern split by "/", used to find the parent directories
+}
+
+func compileIncludeRule(pattern string) (rule includeRule, ok bool) {
+	pattern = strings.TrimLeft(strings.TrimRight(pattern, " "), "/")
+	if strings.HasPrefix(pattern, "!") {
+		progressLn("Negation is not supported in include pattern ", pattern)
+		return
+	}
+
+	rule.excludeRule, ok = compileExcludeRule("/" + pattern)
+	if !ok {
+		return
+	}
+	rule.pattern = strings.TrimRight(pattern, "/")
+	rule.segments = strings.Split(rule.pattern, "/")
+	return rule, true
+}
+
+// SetIncludes replaces include patterns, no patterns means that everything is included
+func (e *Excludes) SetIncludes(patterns ...string) {
+	e.includePatterns, e.includes = nil, nil
+	for _, pattern := range patterns {
+		if rule, ok := compileIncludeRule(pattern); ok {
+			e.includePatterns = append(e.includePatterns, pattern)
+			e.includes = append(e.includes, rule)
+		}
+	}
+}
+
+func (e *Excludes) Includes() []string {
+	return e.includePatterns
+}
+
+// Allows reports whether path is included, i.e. path or one of its parents matches an include pattern
+// or path is a directory that may contain matching paths. Paths outside of sparse paths are never allowed
+func (e *Excludes) Allows(path string, isDir bool) bool {
+	if e == nil || path == "." {
+		return true
+	}
+	if !e.sparseAllows(path, isDir) {
+		return false
+	}
+	if len(e.includes) == 0 {
+		return true
+	}
+
+	for _, rule := range e.includes {
+		if rule.matches(path, isDir) || isDir && rule.isParent(path) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r includeRule) matches(path string, isDir bool) bool {
+	for i := 0; i < len(path); i++ {
+		if path[i] == '/' && r.re.MatchString(path[:i]) {
+			return true
+		}
+	}
+	return (isDir || !r.dirOnly) && r.re.MatchString(path)
+}
+
+func (r includeRule) isParent(dir string) bool {
+	parts := strings.Split(dir, "/")
+	for i, part := range parts {
+		if i >= len(r.segments) {
+			return false
+		}
+		// ** may match any number of directories
+		segment := r.segments[i]
+		if strings.Contains(segment, "**") {
+			return true
+		}
+		// invalid pattern can not be checked, so directory is walked anyway
+		if ok, err := path.Match(strings.Replace(segment, "[!", "[^", -1), part); !ok && err == nil {
+			return false
+		}
+	}
+	return len(parts) < len(r.segments)
+}
+
+// includeRsyncArgs returns rsync filter arguments that include the patterns with their parents and
+// exclude everything else, so they must go after all other filter arguments. Parents of patterns with **
+// are not known, so all directories are included and the ones that end up empty are not created
+func (e *Excludes) includeRsyncArgs() []string {
+	if len(e.includes) == 0 {
+		return nil
+	}
+
+	var args []string
+	pruneEmptyDirs := false
+	for _, rule := range e.includes {
+		pattern := "/" + rule.pattern
+		for i := 1; i < len(rule.segments); i++ {
+			if strings.Contains(rule.segments[i-1], "**") {
+				args = append(args, "--include=*/")
+				pruneEmptyDirs = true
+				break
+			}
+			args = append(args, "--include=/"+strings.Join(rule.segments[:i], "/")+"/")
+		}
+		if strings.HasPrefix(rule.pattern, "**/") {
+			// rsync matches patterns without leading slash at any level
+			pattern = rule.pattern[len("**/"):]
+		}
+		if rule.dirOnly {
+			args = append(args, "--include="+pattern+"/")
+		} else {
+			args = append(args, "--include="+pattern)
+		}
+		args = append(args, "--include="+pattern+"/**")
+	}
+	if pruneEmptyDirs {
+		args = append(args, "--prune-empty-dirs")
+	}
+	return append(args, "--exclude=*")
+}
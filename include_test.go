@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExcludesAllows(t *testing.T) {
+	tests := []struct {
+		includes []string
+		path     string
+		isDir    bool
+		want     bool
+	}{
+		{nil, "anything", false, true},
+		{[]string{"config"}, "config", false, true},
+		{[]string{"config"}, "config/app.yml", false, true},
+		{[]string{"config"}, "a/config", false, false},
+		{[]string{"config"}, "other", false, false},
+		{[]string{"src/*/conf"}, "src", true, true},
+		{[]string{"src/*/conf"}, "src/app", true, true},
+		{[]string{"src/*/conf"}, "src/app/conf/x", false, true},
+		{[]string{"src/*/conf"}, "src/app/other", false, false},
+		{[]string{"src/*/conf"}, "lib", true, false},
+		{[]string{"**/conf"}, "a/b", true, true},
+		{[]string{"**/conf"}, "a/b/conf", false, true},
+		{[]string{"**/conf"}, "a/b/file", false, false},
+		{[]string{"bin/"}, "bin", false, false},
+		{[]string{"bin/"}, "bin", true, true},
+	}
+
+	for _, test := range tests {
+		excludes := NewExcludes()
+		excludes.SetIncludes(test.includes...)
+		if got := excludes.Allows(test.path, test.isDir); got != test.want {
+			t.Errorf("includes %q: Allows(%q, %v) = %v, want %v", test.includes, test.path, test.isDir, got, test.want)
+		}
+	}
+}
+
+func TestIncludeRsyncArgs(t *testing.T) {
+	tests := []struct {
+		includes []string
+		want     []string
+	}{
+		{nil, nil},
+		{[]string{"config"}, []string{"--include=/config", "--include=/config/**", "--exclude=*"}},
+		{[]string{"src/app/"}, []string{"--include=/src/", "--include=/src/app/", "--include=/src/app/**", "--exclude=*"}},
+		{[]string{"**/conf"}, []string{"--include=*/", "--include=conf", "--include=conf/**", "--prune-empty-dirs", "--exclude=*"}},
+	}
+
+	for _, test := range tests {
+		excludes := NewExcludes()
+		excludes.SetIncludes(test.includes...)
+		if got := excludes.includeRsyncArgs(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("includes %q: includeRsyncArgs() = %q, want %q", test.includes, got, test.want)
+		}
+	}
+}
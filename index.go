@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Index is gzipped text file that contains repository and the list of servers that had received
+// all changes at the moment it was saved:
+//
+//	unrealsync-index 2
+//	excludes <excludes separated by |>
+//	server <host>:<dir>
+//	= <dir>
+//	<kind> <mode> <mtime> <size> <encoded hash or -> <name>
+const (
+	indexHeader       = "unrealsync-index 2"
+	indexSaveInterval = time.Minute
+)
+
+func indexExcludesLine(excludes *Excludes) string {
+	return "excludes " + excludes.String()
+}
+
+func serverIndexKey(settings Settings) string {
+	return settings.host + ":" + settings.dir
+}
+
+// setSynced marks whether server has received everything before its log reader: the reader is moved
+// to the end of the log before initial sync, bulk resync or compaction, and the server is not synced until they finish
+func (r *Client) setSynced(synced bool) {
+	r.syncedMutex.Lock()
+	defer r.syncedMutex.Unlock()
+	// changes of a burst are not in the log, they are sent by the requested resync
+	if synced && len(r.resyncCh) > 0 {
+		return
+	}
+	r.synced = synced
+}
+
+func (r *Client) isSynced() bool {
+	r.syncedMutex.Lock()
+	defer r.syncedMutex.Unlock()
+	return r.synced
+}
+
+// syncedServers returns hosts that have received all changes
+func syncedServers(clients map[string]*Client) map[string]bool {
+	result := make(map[string]bool)
+	for hostname := range hostsWithEmptyQueue() {
+		if client, ok := clients[hostname]; ok && client.isSynced() && client.bigFiles.idle() {
+			result[hostname] = true
+		}
+	}
+	return result
+}
+
+// saveIndex must be called with repo locked. Synced servers are stored only when clients are given,
+// which must happen only at clean shutdown: a periodic snapshot can be older than the last sent change
+func saveIndex(clients map[string]*Client) {
+	indexPath := getLogFilePath(repoIndexFilename)
+	tmpPath := indexPath + ".tmp"
+
+	fp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		progressLn("Cannot open ", tmpPath, ": ", err.Error())
+		return
+	}
+
+	gz := gzip.NewWriter(fp)
+	w := bufio.NewWriter(gz)
+
+	fmt.Fprintln(w, indexHeader)
+	fmt.Fprintln(w, indexExcludesLine(repo.excludes))
+	for hostname := range syncedServers(clients) {
+		fmt.Fprintln(w, "server "+serverIndexKey(clients[hostname].settings))
+	}
+
+	for dir, stats := range repo.stats {
+		fmt.Fprintln(w, "= "+dir)
+		for name, stat := range stats {
+			hash := "-"
+			if stat.hash != "" {
+				hash = stat.hash
+			}
+			fmt.Fprintf(w, "%c %o %d %d %s %s\n", stat.Kind(), stat.mode, stat.mtime, stat.size, hash, name)
+		}
+	}
+
+	if err = w.Flush(); err == nil {
+		err = gz.Close()
+	}
+	if closeErr := fp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		progressLn("Cannot write ", tmpPath, ": ", err.Error())
+		os.Remove(tmpPath)
+		return
+	}
+
+	if err = os.Rename(tmpPath, indexPath); err != nil {
+		progressLn("Cannot rename ", tmpPath, " to ", indexPath, ": ", err.Error())
+		return
+	}
+	repo.changed = false
+	debugLn("Saved index to ", indexPath)
+}
+
+// loadIndex reads repository saved by saveIndex. Index is ignored if excludes have changed
+// since then because it may contain files that should not be synced anymore
+func loadIndex(excludes *Excludes) (result *Repository, syncedServers map[string]bool, err error) {
+	fp, err := os.Open(getLogFilePath(repoIndexFilename))
+	if err != nil {
+		return
+	}
+	defer fp.Close()
+
+	gz, err := gzip.NewReader(fp)
+	if err != nil {
+		return
+	}
+
+	result = NewRepository(excludes)
+	syncedServers = make(map[string]bool)
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var dir string
+	for lineNo := 0; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if lineNo == 0 {
+			if line != indexHeader {
+				return nil, nil, errors.New("unsupported index version: " + line)
+			}
+			continue
+		} else if lineNo == 1 {
+			if line != indexExcludesLine(excludes) {
+				return nil, nil, errors.New("excludes have changed")
+			}
+			continue
+		}
+
+		if strings.HasPrefix(line, "server ") {
+			syncedServers[line[len("server "):]] = true
+		} else if strings.HasPrefix(line, "= ") {
+			dir = line[len("= "):]
+			if !result.HasDir(dir) {
+				result.AddDir(dir)
+			}
+		} else {
+			var stat *UnrealStat
+			if stat, err = parseIndexEntry(dir, line); err != nil {
+				return nil, nil, err
+			}
+			if !result.HasDir(dir) {
+				return nil, nil, errors.New("entry outside of dir: " + line)
+			}
+			result.AddFileToDir(dir, filepath.Base(stat.name), stat)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	result.changed = false
+	return
+}
+
+func parseIndexEntry(dir, line string) (*UnrealStat, error) {
+	parts := strings.SplitN(line, " ", 6)
+	if len(parts) != 6 || len(parts[0]) != 1 {
+		return nil, errors.New("malformed index entry: " + line)
+	}
+
+	mode, err := strconv.ParseInt(parts[1], 8, 16)
+	if err != nil {
+		return nil, err
+	}
+	mtime, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	size, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	// hashes made by another algorithm are useless
+	hash := ""
+	if parts[4] != "-" && isCurrentHash(parts[4]) {
+		hash = parts[4]
+	}
+
+	return &UnrealStat{
+		name:   filepath.Join(dir, parts[5]),
+		isDir:  parts[0][0] == 'd',
+		isLink: parts[0][0] == 'l',
+		mode:   int16(mode),
+		mtime:  mtime,
+		size:   size,
+		hash:   hash,
+	}, nil
+}
+
+// indexThread saves index periodically and when unrealsync is stopped
+func indexThread(clients map[string]*Client) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGUSR1)
+
+	for {
+		select {
+		case <-time.After(indexSaveInterval):
+			repo.Lock()
+			if repo.changed {
+				saveIndex(nil)
+			}
+			repo.Unlock()
+		case <-signals:
+			progressLn("Saving index before exit")
+			repo.Lock()
+			saveIndex(clients)
+			os.Exit(0)
+		}
+	}
+}
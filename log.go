@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -14,10 +15,6 @@ import (
 	"time"
 )
 
-const (
-	logMaxSize = 50 * 1048576
-)
-
 type SortableStrings []string
 
 type BufBlocker struct {
@@ -25,13 +22,25 @@ type BufBlocker struct {
 	sent chan bool
 }
 
+// Position of a reader in the log. Log is split into numbered segments: new segment is started
+// when the current one exceeds logSegmentSize and old segments are removed once every reader
+// has moved past them
+type logCursor struct {
+	segment int
+	offset  int64
+}
+
 var (
-	outLogWriteFp     *os.File
-	outLogPos         int64
-	outLogReadFps     map[string]*os.File
-	outLogReadPos     map[string]int64
-	outLogReadOldSize map[string]int64
-	outLogMutex       sync.Mutex
+	logSegmentSize int64 = 50 * 1048576
+
+	outLogWriteFp      *os.File
+	outLogSegment      int
+	outLogPos          int64
+	outLogFirstSegment int
+	outLogSegmentSizes map[int]int64
+	outLogReadFps      map[string]*os.File
+	outLogReaders      map[string]logCursor
+	outLogMutex        sync.Mutex
 )
 
 func (r SortableStrings) Len() int {
@@ -47,11 +56,16 @@ func (r SortableStrings) Swap(i, j int) {
 }
 
 func initializeLogs() {
+	// segments from the previous run are of no use because readers start from scratch
+	oldSegments, _ := filepath.Glob(getLogFilePath(repoLogFilename + "*"))
+	for _, oldSegment := range oldSegments {
+		os.Remove(oldSegment)
+	}
 
-	createOutLog()
+	outLogSegmentSizes = make(map[int]int64)
 	outLogReadFps = make(map[string]*os.File)
-	outLogReadPos = make(map[string]int64)
-	outLogReadOldSize = make(map[string]int64)
+	outLogReaders = make(map[string]logCursor)
+	createOutLogSegment()
 }
 
 func writeToOutLog(action string, buf []byte) {
@@ -65,66 +79,104 @@ func writeToOutLog(action string, buf []byte) {
 
 	outLogPos, err = outLogWriteFp.Seek(0, io.SeekCurrent)
 	debugLn("outlogpos:", outLogPos, " after action:", action)
-	if outLogPos > logMaxSize {
-		for _, oldSize := range outLogReadOldSize {
-			if oldSize != 0 {
-				debugLn("could not reopen log, not all readers are reading from actual")
-				return
-			}
-		}
-		progressLn("Rotating outlog")
-		createOutLog()
+	if outLogPos > logSegmentSize {
+		outLogSegmentSizes[outLogSegment] = outLogPos
+		outLogSegment++
+		debugLn("Starting outlog segment ", outLogSegment)
+		createOutLogSegment()
 	}
 	return
 }
 
-func createOutLog() {
-	logFilePath := getLogFilePath(repoLogFilename)
+func getLogSegmentPath(segment int) string {
+	return getLogFilePath(fmt.Sprintf("%s.%06d", repoLogFilename, segment))
+}
+
+func createOutLogSegment() {
 	if outLogWriteFp != nil {
 		outLogWriteFp.Close()
-		os.Remove(logFilePath)
 	}
+
+	logFilePath := getLogSegmentPath(outLogSegment)
 	var err error
 	outLogWriteFp, err = os.OpenFile(logFilePath, os.O_APPEND|os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0666)
 	if err != nil {
 		fatalLn("Cannot open ", logFilePath, ": ", err.Error())
 	}
-	for hostname := range outLogReadOldSize {
-		// invalidate readers
-		outLogReadOldSize[hostname] = outLogPos
-	}
 	outLogPos = 0
+	removeReadLogSegments()
 }
 
+// removeReadLogSegments deletes segments that all readers have already passed.
+// Must be called with outLogMutex locked
+func removeReadLogSegments() {
+	minSegment := outLogSegment
+	for _, cursor := range outLogReaders {
+		if cursor.segment < minSegment {
+			minSegment = cursor.segment
+		}
+	}
+
+	for ; outLogFirstSegment < minSegment; outLogFirstSegment++ {
+		debugLn("Removing outlog segment ", outLogFirstSegment)
+		os.Remove(getLogSegmentPath(outLogFirstSegment))
+		delete(outLogSegmentSizes, outLogFirstSegment)
+	}
+}
+
+// openOutLogForRead positions reader at the end of the log if continuation is set or at the beginning of it otherwise
 func openOutLogForRead(hostname string, continuation bool) (err error) {
 	outLogMutex.Lock()
 	defer outLogMutex.Unlock()
-	fp, ok := outLogReadFps[hostname]
-	if ok {
-		progressLn("Closing old log fp for ", hostname)
-		err = fp.Close()
-		if err != nil {
-			return
-		}
-	}
+
 	progressLn("Opening log for ", hostname)
-	fp, err = os.Open(getLogFilePath(repoLogFilename))
+	if continuation {
+		return openOutLogSegmentForRead(hostname, logCursor{outLogSegment, outLogPos})
+	}
+	return openOutLogSegmentForRead(hostname, logCursor{outLogFirstSegment, 0})
+}
+
+// must be called with outLogMutex locked
+func openOutLogSegmentForRead(hostname string, cursor logCursor) (err error) {
+	closeOutLogReader(hostname)
+
+	fp, err := os.Open(getLogSegmentPath(cursor.segment))
 	if err != nil {
 		return
 	}
+	if _, err = fp.Seek(cursor.offset, io.SeekStart); err != nil {
+		fp.Close()
+		return
+	}
+
 	outLogReadFps[hostname] = fp
+	outLogReaders[hostname] = cursor
+	removeReadLogSegments()
+	return
+}
 
-	if continuation {
-		_, err = fp.Seek(outLogPos, io.SeekStart)
-		if err != nil {
-			return
-		}
-		outLogReadPos[hostname] = outLogPos
-	} else {
-		outLogReadPos[hostname] = 0
+// closeOutLogReader forgets about the reader so that it does not prevent log segments from removal.
+// Must be called with outLogMutex locked
+func closeOutLogReader(hostname string) {
+	if fp, ok := outLogReadFps[hostname]; ok {
+		debugLn("Closing old log fp for ", hostname)
+		fp.Close()
 	}
-	outLogReadOldSize[hostname] = 0
-	return
+	delete(outLogReadFps, hostname)
+	delete(outLogReaders, hostname)
+}
+
+// pendingLogSize returns number of bytes in the log after cursor. Must be called with outLogMutex locked
+func pendingLogSize(cursor logCursor) (size int64) {
+	if cursor.segment == outLogSegment {
+		return outLogPos - cursor.offset
+	}
+
+	size = outLogSegmentSizes[cursor.segment] - cursor.offset
+	for segment := cursor.segment + 1; segment < outLogSegment; segment++ {
+		size += outLogSegmentSizes[segment]
+	}
+	return size + outLogPos
 }
 
 func doSendChanges(stream chan BufBlocker, client *Client) {
@@ -142,29 +194,61 @@ doSendChangesLoop:
 		case <-client.stopCh:
 			progressLn("Got stop sendChanges")
 			break doSendChangesLoop
+		case <-client.resyncCh:
+			if err = client.bulkResync(); err != nil {
+				sendErrorNonBlocking(client.errorCh, err)
+				break doSendChangesLoop
+			}
+			continue
+		case <-client.copyMissCh:
+			if !client.resendCopyMisses() {
+				sendErrorNonBlocking(client.errorCh, errors.New("Could not resend files to "+hostname))
+				break doSendChangesLoop
+			}
+			continue
+		case <-client.verifyCh:
+			if err = client.verify(); err != nil {
+				sendErrorNonBlocking(client.errorCh, err)
+				break doSendChangesLoop
+			}
+			continue
 		default:
 		}
 		outLogMutex.Lock()
+		cursor, ok := outLogReaders[hostname]
+		pendingSize := pendingLogSize(cursor)
+		localOutLogSegment := outLogSegment
 		localOutLogPos := outLogPos
-		localOldSize := outLogReadOldSize[hostname]
-		localReadPos := outLogReadPos[hostname]
+		segmentSize := outLogSegmentSizes[cursor.segment]
 		fp := outLogReadFps[hostname]
 		outLogMutex.Unlock()
 
-		if localReadPos == localOutLogPos && localOldSize == 0 {
+		// reader is removed when send queue limit is exceeded, we are going to be stopped soon
+		if !ok || cursor.segment == localOutLogSegment && cursor.offset == localOutLogPos {
 			time.Sleep(time.Millisecond * 20)
 			continue
 		}
 
-		bufLen, err = readLogEntry(fp, buf)
-		if err == io.EOF {
-			err = openOutLogForRead(hostname, false)
+		if client.settings.compactQueueSize != 0 && pendingSize > client.settings.compactQueueSize {
+			if !compactQueue(client) {
+				sendErrorNonBlocking(client.errorCh, errors.New("Compaction of the queue for "+hostname+" failed"))
+				break
+			}
+			continue
+		}
+
+		if cursor.segment < localOutLogSegment && cursor.offset == segmentSize {
+			outLogMutex.Lock()
+			err = openOutLogSegmentForRead(hostname, logCursor{cursor.segment + 1, 0})
+			outLogMutex.Unlock()
 			if err != nil {
 				sendErrorNonBlocking(client.errorCh, err)
 				break
 			}
 			continue
 		}
+
+		bufLen, err = readLogEntry(fp, buf)
 		if err != nil {
 			sendErrorNonBlocking(client.errorCh, err)
 			break
@@ -176,24 +260,77 @@ doSendChangesLoop:
 			break
 		}
 
-		bufBlocker.buf = buf[0:bufLen]
-		select {
-		case stream <- bufBlocker:
-		case <-client.stopCh:
-			progressLn("Got stop sendChanges2")
-			break doSendChangesLoop
-		}
-		select {
-		case <-bufBlocker.sent:
-		case <-client.stopCh:
-			progressLn("Got stop sendChanges3")
-			break doSendChangesLoop
+		if string(buf[0:10]) == actionBigRef {
+			if file, stat := parseBigFilePayload(buf[20:bufLen]); client.isExcluded(file, &stat) {
+				debugLn("Skipping ", file, " excluded for ", hostname)
+			} else if !client.bigFiles.add(buf[20:bufLen], client.stopCh) {
+				break doSendChangesLoop
+			}
+		} else if frame := client.filterLogEntry(buf[0:bufLen]); frame != nil {
+			// big files are queued with local names
+			diff := buf[20:bufLen]
+			if !client.bigFiles.wait(func() bool { return client.bigFiles.conflicts(diff) }, client.stopCh) {
+				break doSendChangesLoop
+			}
+			bufBlocker.buf = frame
+			select {
+			case stream <- bufBlocker:
+			case <-client.stopCh:
+				progressLn("Got stop sendChanges2")
+				break doSendChangesLoop
+			}
+			select {
+			case <-bufBlocker.sent:
+			case <-client.stopCh:
+				progressLn("Got stop sendChanges3")
+				break doSendChangesLoop
+			}
 		}
 		outLogMutex.Lock()
-		outLogReadPos[hostname] = pos
+		if _, ok := outLogReaders[hostname]; ok {
+			outLogReaders[hostname] = logCursor{cursor.segment, pos}
+		}
 		outLogMutex.Unlock()
-		debugLn("hostname:", hostname, " pos:", pos, " after reading", string(buf[0:10]))
+		debugLn("hostname:", hostname, " segment:", cursor.segment, " pos:", pos, " after reading", string(buf[0:10]))
+	}
+}
+
+// filterLogEntry removes changes that are excluded by the server's own rules from the log entry
+// and converts names for the server (see remoteEntry), returns nil if nothing is left to send
+func (r *Client) filterLogEntry(frame []byte) []byte {
+	if string(frame[0:10]) != actionDiff {
+		return frame
+	}
+
+	diff := filterDiff(frame[20:], func(entry *diffEntry) bool {
+		stat := &entry.stat
+		if entry.op == 'D' {
+			stat = nil
+		}
+		return !r.isExcluded(entry.file, stat) && r.remoteEntry(entry)
+	})
+	if bytes.Equal(diff, frame[20:]) {
+		return frame
+	} else if len(diff) == 0 {
+		return nil
+	}
+
+	result := make([]byte, 0, 20+len(diff))
+	return append(append(append(result, frame[0:10]...), fmt.Sprintf("%10d", len(diff))...), diff...)
+}
+
+// hostsWithEmptyQueue returns hosts that have received everything written to the log
+func hostsWithEmptyQueue() map[string]bool {
+	outLogMutex.Lock()
+	defer outLogMutex.Unlock()
+
+	result := make(map[string]bool)
+	for hostname, cursor := range outLogReaders {
+		if cursor.segment == outLogSegment && cursor.offset == outLogPos {
+			result[hostname] = true
+		}
 	}
+	return result
 }
 
 func printStatusThread(clients map[string]*Client) {
@@ -204,27 +341,40 @@ func printStatusThread(clients map[string]*Client) {
 		statuses := make([]string, 0)
 
 		outLogMutex.Lock()
-		for hostname, oldSize := range outLogReadOldSize {
-			if oldSize != 0 {
-				sendQueueSize = oldSize - outLogReadPos[hostname] + outLogPos
-				statuses = append(statuses, hostname+" "+formatLength(int(sendQueueSize))+"*")
-			} else if outLogReadPos[hostname] != outLogPos {
-				sendQueueSize = outLogPos - outLogReadPos[hostname]
+		for hostname, cursor := range outLogReaders {
+			sendQueueSize = pendingLogSize(cursor)
+			if sendQueueSize != 0 {
 				statuses = append(statuses, hostname+" "+formatLength(int(sendQueueSize)))
-			} else {
-				sendQueueSize = 0
 			}
 			if err := clients[hostname].notifySendQueueSize(sendQueueSize); err != nil {
-				progressLn("removing " + hostname + " from outLogReadOldSize")
-				delete(outLogReadOldSize, hostname)
+				progressLn("removing " + hostname + " from log readers")
+				closeOutLogReader(hostname)
+				removeReadLogSegments()
 			}
 		}
 		outLogMutex.Unlock()
 
 		sort.Sort(SortableStrings(statuses))
 
+		transfers := make([]string, 0)
+		for hostname, client := range clients {
+			if status := client.syncProgress.String(); status != "" {
+				transfers = append(transfers, hostname+" sync "+status)
+			}
+			if status := client.bigProgress.String(); status != "" {
+				transfers = append(transfers, hostname+" "+status)
+			}
+		}
+		sort.Sort(SortableStrings(transfers))
+
 		runtime.ReadMemStats(mem)
-		if len(statuses) > 0 {
+		if len(transfers) > 0 && len(statuses) > 0 {
+			progress("Pending diffs: ", strings.Join(statuses, "; "), " Transfers: ", strings.Join(transfers, "; "))
+			prevStatusesOk = false
+		} else if len(transfers) > 0 {
+			progress("Transfers: ", strings.Join(transfers, "; "))
+			prevStatusesOk = false
+		} else if len(statuses) > 0 {
 			progress("Pending diffs: ", strings.Join(statuses, "; "))
 			prevStatusesOk = false
 		} else if !prevStatusesOk {
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// initTestLog starts an empty log with small segments in a temporary directory
+func initTestLog(t *testing.T, segmentSize int64) {
+	chdirTemp(t)
+	oldSegmentSize := logSegmentSize
+	t.Cleanup(func() {
+		outLogMutex.Lock()
+		for hostname := range outLogReaders {
+			closeOutLogReader(hostname)
+		}
+		outLogWriteFp.Close()
+		outLogWriteFp, outLogSegment, outLogFirstSegment = nil, 0, 0
+		outLogMutex.Unlock()
+		logSegmentSize = oldSegmentSize
+	})
+
+	logSegmentSize = segmentSize
+	outLogWriteFp, outLogSegment, outLogFirstSegment = nil, 0, 0
+	initializeLogs()
+}
+
+func logSegmentExists(segment int) bool {
+	_, err := os.Stat(getLogSegmentPath(segment))
+	return err == nil
+}
+
+func TestLogSegments(t *testing.T) {
+	// every entry is 20 + 50 bytes, so there are two entries in a segment
+	initTestLog(t, 100)
+	if err := openOutLogForRead("a", false); err != nil {
+		t.Fatal(err)
+	}
+
+	payloads := []string{"0", "1", "2", "3", "4"}
+	for _, payload := range payloads {
+		writeToOutLog(actionDiff, []byte(strings.Repeat(payload, 50)))
+	}
+	if outLogSegment != 2 || outLogPos != 70 {
+		t.Fatalf("log is at segment %d pos %d, want 2 and 70", outLogSegment, outLogPos)
+	}
+	if want := map[int]int64{0: 140, 1: 140}; !reflect.DeepEqual(outLogSegmentSizes, want) {
+		t.Errorf("segment sizes %v, want %v", outLogSegmentSizes, want)
+	}
+
+	tests := []struct {
+		cursor logCursor
+		want   int64
+	}{
+		{logCursor{0, 0}, 350},
+		{logCursor{0, 70}, 280},
+		{logCursor{1, 140}, 70},
+		{logCursor{2, 0}, 70},
+		{logCursor{2, 70}, 0},
+	}
+	for _, test := range tests {
+		if got := pendingLogSize(test.cursor); got != test.want {
+			t.Errorf("pendingLogSize(%v) = %d, want %d", test.cursor, got, test.want)
+		}
+	}
+
+	// new reader that continues from the end has nothing to read
+	if err := openOutLogForRead("b", true); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := hostsWithEmptyQueue(), map[string]bool{"b": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("hostsWithEmptyQueue() = %v, want %v", got, want)
+	}
+
+	// segments are read one by one as doSendChanges does it
+	buf := make([]byte, 100)
+	var read []string
+	for segment := 0; segment <= outLogSegment; segment++ {
+		if segment > 0 {
+			outLogMutex.Lock()
+			err := openOutLogSegmentForRead("a", logCursor{segment, 0})
+			outLogMutex.Unlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		for {
+			n, err := readLogEntry(outLogReadFps["a"], buf)
+			if err != nil {
+				break
+			}
+			if string(buf[0:10]) != actionDiff || n != 70 {
+				t.Fatalf("readLogEntry() = %q", buf[0:n])
+			}
+			read = append(read, string(buf[20]))
+		}
+		if segment > 0 && logSegmentExists(segment-1) {
+			t.Errorf("segment %d was not removed after it was read", segment-1)
+		}
+	}
+	if !reflect.DeepEqual(read, payloads) {
+		t.Errorf("read %q, want %q", read, payloads)
+	}
+}
+
+func TestLogSegmentsRemovedWithReader(t *testing.T) {
+	initTestLog(t, 100)
+	if err := openOutLogForRead("slow", false); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		writeToOutLog(actionDiff, []byte(strings.Repeat("x", 50)))
+	}
+	if err := openOutLogForRead("fast", true); err != nil {
+		t.Fatal(err)
+	}
+
+	// the slow reader keeps all segments
+	for segment := 0; segment <= 2; segment++ {
+		if !logSegmentExists(segment) {
+			t.Errorf("segment %d was removed while it is read", segment)
+		}
+	}
+
+	// e.g. when the send queue limit is exceeded
+	outLogMutex.Lock()
+	closeOutLogReader("slow")
+	removeReadLogSegments()
+	outLogMutex.Unlock()
+
+	for segment := 0; segment <= 2; segment++ {
+		if exists, want := logSegmentExists(segment), segment == 2; exists != want {
+			t.Errorf("segment %d exists: %v, want %v", segment, exists, want)
+		}
+	}
+
+	// reader that starts from the beginning starts at the first segment that is left
+	if err := openOutLogForRead("slow", false); err != nil {
+		t.Fatal(err)
+	}
+	if cursor := outLogReaders["slow"]; cursor != (logCursor{2, 0}) {
+		t.Errorf("new reader is at %v, want {2 0}", cursor)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Path mappings place subtrees of the synced directory into other directories of the server:
+// with "map = docs => /var/www/docs" in a server section docs/a.html goes to /var/www/docs/a.html
+// instead of <dir>/docs/a.html. Several mappings are separated by "|". Client sends paths as usual,
+// server maps them when applying changes. Each mapping is copied by its own rsync, and reconciliation
+// is not supported for servers with mappings, because server repository covers a single directory.
+// Every mapped directory has its own .unrealsync for temporary files, so that they can be renamed
+// into place even if it is on another file system. It is accessible only by the owner, and it is never
+// changed or deleted by sync, because .unrealsync is excluded at any level.
+
+type pathMapping struct {
+	prefix string // relative to the root of the synced directory
+	dir    string // directory on the server
+}
+
+// mapFlagSep separates prefix and dir in --map flag passed to the server
+const mapFlagSep = "=>"
+
+// serverMappings are mappings of the server, the longest prefixes go first
+var serverMappings []pathMapping
+
+// parseMappings parses "prefix => dir | prefix => dir"
+func parseMappings(value string) ([]pathMapping, error) {
+	var result []pathMapping
+	for _, part := range strings.Split(value, "|") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		sides := strings.SplitN(part, mapFlagSep, 2)
+		if len(sides) != 2 {
+			return nil, errors.New("expected 'prefix => remote dir', got '" + strings.TrimSpace(part) + "'")
+		}
+
+		prefix := path.Clean(strings.Trim(strings.TrimSpace(sides[0]), "/"))
+		dir := strings.TrimSpace(sides[1])
+		if prefix == "." || strings.HasPrefix(prefix, "../") || prefix == ".." || dir == "" {
+			return nil, errors.New("bad mapping '" + strings.TrimSpace(part) + "'")
+		}
+		result = append(result, pathMapping{prefix, strings.TrimRight(dir, "/")})
+	}
+
+	sort.Slice(result, func(i, j int) bool { return len(result[i].prefix) > len(result[j].prefix) })
+	return result, nil
+}
+
+func (m pathMapping) flag() string {
+	return m.prefix + mapFlagSep + m.dir
+}
+
+// repoPathFor returns repository directory of the root that contains mapped file
+func repoPathFor(mappedFile string) string {
+	for _, m := range serverMappings {
+		if mappedFile == m.dir || strings.HasPrefix(mappedFile, m.dir+"/") {
+			return filepath.Join(m.dir, defaultRepoDir)
+		}
+	}
+	return repoPath
+}
+
+// tmpDirFor returns directory for temporary files that are renamed into the mapped file
+func tmpDirFor(mappedFile string) string {
+	return path.Join(repoPathFor(mappedFile), repoTmp)
+}
+
+// mapPath returns the location of file on the server
+func mapPath(file string) string {
+	for _, m := range serverMappings {
+		if file == m.prefix || strings.HasPrefix(file, m.prefix+"/") {
+			return m.dir + file[len(m.prefix):]
+		}
+	}
+	return file
+}
+
+// Under returns rules for the subtree at prefix as if it was the root of the synced directory,
+// it is used for rsync of mappings. Anchored patterns that are outside of prefix are dropped.
+// Prefix itself must be allowed and not excluded
+func (e *Excludes) Under(prefix string) *Excludes {
+	result := &Excludes{sparse: e.sparseUnder(prefix), minFileSize: e.minFileSize, maxFileSize: e.maxFileSize, skipTypes: e.skipTypes}
+
+	for i, pattern := range e.patterns {
+		if !e.rules[i].anchored {
+			result.Add(pattern)
+			continue
+		}
+		negation := ""
+		if e.rules[i].negate {
+			negation, pattern = "!", pattern[1:]
+		}
+		if rest := strings.TrimPrefix(strings.TrimPrefix(pattern, "/"), prefix+"/"); len(rest) < len(strings.TrimPrefix(pattern, "/")) {
+			result.Add(negation + "/" + rest)
+		}
+	}
+
+	var includes []string
+	for _, rule := range e.includes {
+		if rule.matches(prefix, true) {
+			// the whole subtree is included
+			return result
+		}
+		if rest, ok := rule.under(prefix); ok {
+			includes = append(includes, rest)
+		}
+	}
+	result.SetIncludes(includes...)
+	return result
+}
+
+// under returns the rest of the include pattern below dir if dir is its parent
+func (r includeRule) under(dir string) (string, bool) {
+	if !r.isParent(dir) {
+		return "", false
+	}
+	parts := strings.Split(dir, "/")
+	for i := range parts {
+		if strings.Contains(r.segments[i], "**") {
+			return strings.Join(r.segments[i:], "/"), true
+		}
+	}
+	return strings.Join(r.segments[len(parts):], "/"), true
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMappings(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []pathMapping
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"docs => /var/www/docs", []pathMapping{{"docs", "/var/www/docs"}}, false},
+		{" /docs/ =>/var/www/docs/ | ", []pathMapping{{"docs", "/var/www/docs"}}, false},
+		{"a => /x | a/b/c => /z | a/b => /y", []pathMapping{{"a/b/c", "/z"}, {"a/b", "/y"}, {"a", "/x"}}, false},
+		{"docs", nil, true},
+		{"docs => ", nil, true},
+		{". => /x", nil, true},
+		{"../a => /x", nil, true},
+	}
+
+	for _, test := range tests {
+		got, err := parseMappings(test.value)
+		if (err != nil) != test.wantErr || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseMappings(%q) = %v, %v, want %v, error %v", test.value, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func TestMapPath(t *testing.T) {
+	oldMappings, oldRepoPath := serverMappings, repoPath
+	defer func() { serverMappings, repoPath = oldMappings, oldRepoPath }()
+
+	var err error
+	if serverMappings, err = parseMappings("docs => /var/www/docs | docs/img => /srv/img"); err != nil {
+		t.Fatal(err)
+	}
+	repoPath = defaultRepoDir
+
+	tests := []struct {
+		file    string
+		want    string
+		repoDir string
+	}{
+		{"src/main.go", "src/main.go", defaultRepoDir},
+		{"docs", "/var/www/docs", "/var/www/docs/.unrealsync"},
+		{"docs/a.html", "/var/www/docs/a.html", "/var/www/docs/.unrealsync"},
+		{"docs/img/a.png", "/srv/img/a.png", "/srv/img/.unrealsync"},
+		{"docs/images/a.png", "/var/www/docs/images/a.png", "/var/www/docs/.unrealsync"},
+		{"docsearch/a", "docsearch/a", defaultRepoDir},
+	}
+
+	for _, test := range tests {
+		got := mapPath(test.file)
+		if got != test.want {
+			t.Errorf("mapPath(%q) = %q, want %q", test.file, got, test.want)
+		}
+		if repoDir := repoPathFor(got); repoDir != test.repoDir {
+			t.Errorf("repoPathFor(%q) = %q, want %q", got, repoDir, test.repoDir)
+		}
+	}
+}
+
+func TestExcludesUnder(t *testing.T) {
+	excludes := NewExcludes(".unrealsync", "*.log", "/docs/tmp", "/src/tmp", "!/docs/tmp/keep")
+	under := excludes.Under("docs")
+
+	want := []string{".unrealsync", "*.log", "/tmp", "!/tmp/keep"}
+	if got := under.Patterns(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Under(\"docs\").Patterns() = %q, want %q", got, want)
+	}
+	// state of the mapping on the server is not deleted by its rsync
+	if !under.Match(".unrealsync", true) {
+		t.Errorf("Under(\"docs\") does not exclude .unrealsync")
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Names of files created on macOS are often decomposed (NFD), while tools on Linux expect composed (NFC)
+// names. With "normalize-names = nfc|nfd" in a server section every path is converted to that form on
+// the way to the server: log entries, compacted changes, reconciliation and big files. Names that are not
+// valid UTF-8 are sent as is. If several names of a directory become equal after conversion, the one that
+// is already in the form wins (otherwise the smallest one), the others are not sent. Both cases are reported.
+// Rsync cannot convert names, so such servers are always reconciled.
+
+var nameForms = map[string]norm.Form{"nfc": norm.NFC, "nfd": norm.NFD}
+
+// parseNormalizeNames returns "nfc", "nfd" or "" for none
+func parseNormalizeNames(value string) (string, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "" || value == "none" {
+		return "", nil
+	}
+	if _, ok := nameForms[value]; !ok {
+		return "", errors.New("expected nfc, nfd or none, got '" + value + "'")
+	}
+	return value, nil
+}
+
+// collides returns the name of dir that wins over name when both have the same normalized form
+func collides(form norm.Form, dir map[string]*UnrealStat, name string) (winner string, ok bool) {
+	if form.IsNormalString(name) {
+		return "", false
+	}
+	normalized := form.String(name)
+	for other := range dir {
+		if other != name && form.String(other) == normalized && (other == normalized || other < name) {
+			if !ok || other == normalized || winner != normalized && other < winner {
+				winner, ok = other, true
+			}
+		}
+	}
+	return
+}
+
+// remoteName returns the name of file on the server, ok is false if file must not be sent
+func (r *Client) remoteName(file string) (remoteFile string, ok bool) {
+	form, enabled := nameForms[r.settings.normalizeNames]
+	if !enabled || form.IsNormalString(file) {
+		return file, true
+	}
+	if !utf8.ValidString(file) {
+		r.skipped.report(file+" for "+r.settings.host, "name is not valid UTF-8, it is sent as is")
+		return file, true
+	}
+
+	repo.Lock()
+	defer repo.Unlock()
+
+	parts := strings.Split(file, "/")
+	for i, name := range parts {
+		dir := filepath.Dir(strings.Join(parts[:i+1], "/"))
+		if winner, ok := collides(form, repo.GetDirStat(dir), name); ok {
+			// deletion of the other name is not a collision, e.g. the file was renamed to another form
+			if _, exists := repo.GetDirStat(filepath.Dir(file))[filepath.Base(file)]; exists {
+				r.skipped.report(file+" for "+r.settings.host, "same name as "+filepath.Join(dir, winner)+" in "+strings.ToUpper(r.settings.normalizeNames))
+			}
+			return "", false
+		}
+	}
+	return form.String(file), true
+}
+
+// localName returns the local file for the name received from the server
+func (r *Client) localName(remoteFile string) string {
+	form, enabled := nameForms[r.settings.normalizeNames]
+	if !enabled {
+		return remoteFile
+	}
+
+	repo.Lock()
+	defer repo.Unlock()
+
+	file := "."
+	for _, name := range strings.Split(remoteFile, "/") {
+		dir := repo.GetDirStat(file)
+		if _, ok := dir[name]; !ok {
+			for other := range dir {
+				if _, lost := collides(form, dir, other); !lost && form.String(other) == name {
+					name = other
+					break
+				}
+			}
+		}
+		file = filepath.Join(file, name)
+	}
+	return file
+}
+
+// remoteEntry converts names of the diff entry for the server, returns false if it must not be sent.
+// Source of a copy is left as is if it cannot be converted: server asks for contents when it cannot copy
+func (r *Client) remoteEntry(entry *diffEntry) bool {
+	file, ok := r.remoteName(entry.file)
+	if !ok {
+		return false
+	}
+	entry.file = file
+
+	if entry.op == 'C' {
+		if parts := strings.SplitN(entry.ref, " ", 2); len(parts) == 2 {
+			if source, ok := r.remoteName(parts[1]); ok {
+				entry.ref = parts[0] + " " + source
+			}
+		}
+	}
+	return true
+}
+
+// remoteDiff converts names in the diff for the server
+func (r *Client) remoteDiff(buf []byte) []byte {
+	if r.settings.normalizeNames == "" {
+		return buf
+	}
+	return filterDiff(buf, r.remoteEntry)
+}
+
+// remoteDirs converts names of the directories requested for reconciliation
+func (r *Client) remoteDirs(dirs []string) []string {
+	if r.settings.normalizeNames == "" {
+		return dirs
+	}
+	result := make([]string, len(dirs))
+	for i, dir := range dirs {
+		if remoteDir, ok := r.remoteName(dir); ok {
+			result[i] = remoteDir
+		} else {
+			result[i] = dir
+		}
+	}
+	return result
+}
+
+// localTree converts the tree reply for remoteDirs(dirs) back to local names. Remote names that do not
+// correspond to local ones are kept to be deleted, unless they are not in the form: deletion of such name
+// would be converted too and would delete another file
+func (r *Client) localTree(dirs []string, remoteDirs []string, remote map[string]*remoteDir) map[string]*remoteDir {
+	form, enabled := nameForms[r.settings.normalizeNames]
+	if !enabled {
+		return remote
+	}
+
+	repo.Lock()
+	defer repo.Unlock()
+
+	result := make(map[string]*remoteDir)
+	for i, remoteDirName := range remoteDirs {
+		remoteInfo, ok := remote[remoteDirName]
+		if !ok {
+			continue
+		}
+
+		dir := dirs[i]
+		local := repo.GetDirStat(dir)
+		names := make(map[string]string, len(local))
+		for name := range local {
+			if _, lost := collides(form, local, name); !lost {
+				names[form.String(name)] = name
+			}
+		}
+
+		converted := &remoteDir{exists: remoteInfo.exists, hash: remoteInfo.hash, entries: make(map[string]remoteEntry)}
+		for name, entry := range remoteInfo.entries {
+			if localName, ok := names[name]; ok {
+				converted.entries[localName] = entry
+			} else if form.IsNormalString(name) {
+				converted.entries[name] = entry
+			} else {
+				r.skipped.report(filepath.Join(remoteDirName, name)+" at "+r.settings.host, "name on the server is not in "+strings.ToUpper(r.settings.normalizeNames)+", it is not deleted")
+			}
+		}
+		result[dir] = converted
+	}
+	return result
+}
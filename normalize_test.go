@@ -0,0 +1,169 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+const (
+	cafeNFC   = "caf\u00e9"
+	cafeNFD   = "cafe\u0301"
+	menuNFC   = "men\u00fc.txt"
+	menuNFD   = "menu\u0308.txt"
+	resumeNFC = "r\u00e9sum\u00e9.txt"
+	resumeNFD = "re\u0301sume\u0301.txt"
+)
+
+// setNormalizeRepo replaces repo with the one that has NFD and NFC names, resumeNFC and resumeNFD collide
+func setNormalizeRepo(t *testing.T) {
+	oldRepo := repo
+	t.Cleanup(func() { repo = oldRepo })
+
+	file := func() *UnrealStat { return &UnrealStat{mode: 0644, mtime: 1, size: 3} }
+	repo = NewRepository(NewExcludes())
+	repo.SetDirStat(".", map[string]*UnrealStat{
+		cafeNFD:     {isDir: true, mode: 0755},
+		"plain.txt": file(),
+		resumeNFC:   file(),
+		resumeNFD:   file(),
+	})
+	repo.SetDirStat(cafeNFD, map[string]*UnrealStat{menuNFD: file(), "a.txt": file()})
+}
+
+func normalizeClient(form string) *Client {
+	return &Client{settings: Settings{host: "host", normalizeNames: form}}
+}
+
+func TestParseNormalizeNames(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"none", "", false},
+		{"NFC", "nfc", false},
+		{" nfd ", "nfd", false},
+		{"nfkc", "", true},
+	}
+
+	for _, test := range tests {
+		got, err := parseNormalizeNames(test.value)
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("parseNormalizeNames(%q) = %q, %v, want %q, error %v", test.value, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func TestRemoteName(t *testing.T) {
+	setNormalizeRepo(t)
+	tests := []struct {
+		form   string
+		file   string
+		want   string
+		wantOk bool
+	}{
+		{"", cafeNFD + "/" + menuNFD, cafeNFD + "/" + menuNFD, true},
+		{"nfc", "plain.txt", "plain.txt", true},
+		{"nfc", cafeNFD, cafeNFC, true},
+		{"nfc", cafeNFD + "/" + menuNFD, cafeNFC + "/" + menuNFC, true},
+		{"nfc", cafeNFD + "/new.txt", cafeNFC + "/new.txt", true},
+		{"nfc", resumeNFC, resumeNFC, true},
+		{"nfc", resumeNFD, "", false},
+		{"nfc", "bad\xff" + cafeNFD, "bad\xff" + cafeNFD, true},
+		{"nfd", cafeNFD + "/" + menuNFD, cafeNFD + "/" + menuNFD, true},
+		{"nfd", resumeNFD, resumeNFD, true},
+		{"nfd", resumeNFC, "", false},
+	}
+
+	for _, test := range tests {
+		got, ok := normalizeClient(test.form).remoteName(test.file)
+		if got != test.want || ok != test.wantOk {
+			t.Errorf("%s: remoteName(%+q) = %+q, %v, want %+q, %v", test.form, test.file, got, ok, test.want, test.wantOk)
+		}
+	}
+}
+
+func TestLocalName(t *testing.T) {
+	setNormalizeRepo(t)
+	tests := []struct {
+		form       string
+		remoteFile string
+		want       string
+	}{
+		{"", cafeNFC, cafeNFC},
+		{"nfc", cafeNFC + "/" + menuNFC, cafeNFD + "/" + menuNFD},
+		{"nfc", cafeNFC + "/a.txt", cafeNFD + "/a.txt"},
+		{"nfc", resumeNFC, resumeNFC},
+		{"nfc", "new/" + menuNFC, "new/" + menuNFC},
+		{"nfd", cafeNFD + "/" + menuNFD, cafeNFD + "/" + menuNFD},
+		{"nfd", resumeNFD, resumeNFD},
+	}
+
+	for _, test := range tests {
+		if got := normalizeClient(test.form).localName(test.remoteFile); got != test.want {
+			t.Errorf("%s: localName(%+q) = %+q, want %+q", test.form, test.remoteFile, got, test.want)
+		}
+	}
+}
+
+func TestLocalTree(t *testing.T) {
+	setNormalizeRepo(t)
+	client := normalizeClient("nfc")
+
+	dirs := []string{".", cafeNFD}
+	remoteDirs := client.remoteDirs(dirs)
+	if want := []string{".", cafeNFC}; !reflect.DeepEqual(remoteDirs, want) {
+		t.Fatalf("remoteDirs(%+q) = %+q, want %+q", dirs, remoteDirs, want)
+	}
+
+	remote := parseTreeReply([]byte("= h1 .\n" +
+		"d h2 " + cafeNFC + "\n" +
+		"f h3 plain.txt\n" +
+		"f h4 " + resumeNFC + "\n" +
+		"f h5 gone.txt\n" +
+		"f h6 stale" + cafeNFD + "\n" +
+		"= h7 " + cafeNFC + "\n" +
+		"f h8 " + menuNFC + "\n"))
+
+	got := client.localTree(dirs, remoteDirs, remote)
+	want := map[string]*remoteDir{
+		".": {exists: true, hash: "h1", entries: map[string]remoteEntry{
+			cafeNFD:     {'d', "h2"},
+			"plain.txt": {'f', "h3"},
+			resumeNFC:   {'f', "h4"},
+			"gone.txt":  {'f', "h5"},
+		}},
+		cafeNFD: {exists: true, hash: "h7", entries: map[string]remoteEntry{menuNFD: {'f', "h8"}}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("localTree() = %+v, want %+v", got, want)
+	}
+}
+
+func TestRemoteDiff(t *testing.T) {
+	setNormalizeRepo(t)
+	stat := UnrealStat{mode: 0644, mtime: 1, size: 3}.Serialize()
+
+	diff := []byte("A " + cafeNFD + "/a.txt\n" + stat + diffSep + "abc" +
+		"D " + resumeNFD + diffSep +
+		"C " + cafeNFD + "/b.txt\n" + stat + "\nxxh3:1 " + cafeNFD + "/a.txt" + diffSep +
+		"A plain.txt\n" + stat + diffSep + "xyz")
+
+	if got := normalizeClient("").remoteDiff(diff); string(got) != string(diff) {
+		t.Errorf("remoteDiff() without normalize-names = %+q, want %+q", got, diff)
+	}
+
+	want := "A " + cafeNFC + "/a.txt\n" + stat + diffSep + "abc" +
+		"C " + cafeNFC + "/b.txt\n" + stat + "\nxxh3:1 " + cafeNFC + "/a.txt" + diffSep +
+		"A plain.txt\n" + stat + diffSep + "xyz"
+	if got := normalizeClient("nfc").remoteDiff(diff); string(got) != want {
+		t.Errorf("remoteDiff() = %+q, want %+q", got, want)
+	}
+
+	// names that are already in the form are sent unchanged
+	nfdDiff := []byte("A " + cafeNFD + "/" + menuNFD + "\n" + stat + diffSep + "abc")
+	if got := normalizeClient("nfd").remoteDiff(nfdDiff); string(got) != string(nfdDiff) {
+		t.Errorf("remoteDiff() = %+q, want %+q", got, nfdDiff)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Exclude presets are named lists of exclude patterns for common temporary files, they are enabled
+// with "exclude-presets" in general settings or --exclude-presets and go before other excludes,
+// so that they can be overridden by "!pattern"
+var excludePresets = map[string][]string{
+	"editors": {
+		// vim swap and backup files, 4913 is created by vim to check that directory is writable
+		"*.swp", "*.swo", "*.swx", "4913", "*~",
+		// emacs lock and autosave files
+		".#*", "\\#*#",
+		// JetBrains IDEs safe write
+		"*___jb_tmp___", "*___jb_old___",
+	},
+	"node": {
+		"node_modules/", ".npm/", ".yarn/cache/", ".pnpm-store/", ".next/", ".nuxt/", ".parcel-cache/",
+		"npm-debug.log*", "yarn-debug.log*", "yarn-error.log*",
+	},
+	"python": {
+		"__pycache__/", "*.py[cod]", ".pytest_cache/", ".mypy_cache/", ".ruff_cache/", ".tox/", ".nox/",
+		".venv/", "*.egg-info/", ".coverage",
+	},
+	"jvm": {
+		"*.class", ".gradle/", "/target/", "/build/", "/out/", "*.hprof", "hs_err_pid*.log",
+	},
+}
+
+func excludePresetNames() []string {
+	names := make([]string, 0, len(excludePresets))
+	for name := range excludePresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// presetPatterns expands comma separated list of presets, source is used in the error message
+func presetPatterns(presets string, source string) []string {
+	var patterns []string
+	for _, name := range strings.Split(presets, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		preset, ok := excludePresets[name]
+		if !ok {
+			fatalLn("Unknown exclude preset '", name, "' in ", source, ", available are: ", strings.Join(excludePresetNames(), ", "))
+		}
+		patterns = append(patterns, preset...)
+	}
+	return patterns
+}
+
+func printExcludePresets() {
+	for _, name := range excludePresetNames() {
+		fmt.Println(name + ": " + strings.Join(excludePresets[name], " "))
+	}
+}
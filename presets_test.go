@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestExcludePresetsCompile(t *testing.T) {
+	for name, patterns := range excludePresets {
+		if got := NewExcludes(patterns...).Patterns(); len(got) != len(patterns) {
+			t.Errorf("preset %s: %d of %d patterns are used: %q", name, len(got), len(patterns), got)
+		}
+	}
+}
+
+func TestExcludePresetsMatch(t *testing.T) {
+	tests := []struct {
+		preset string
+		path   string
+		isDir  bool
+		want   bool
+	}{
+		{"editors", "#foo#", false, true},
+		{"editors", "src/#main.go#", false, true},
+		{"editors", "src/.#main.go", false, true},
+		{"editors", "src/main.go.swp", false, true},
+		{"editors", "src/main.go~", false, true},
+		{"editors", "src/main.go", false, false},
+		{"node", "web/node_modules", true, true},
+		{"node", "web/node_modules", false, false},
+		{"python", "pkg/__pycache__/mod.pyc", false, true},
+		{"python", "pkg/mod.py", false, false},
+		{"jvm", "build/classes", false, true},
+		{"jvm", "app/build/classes", false, false},
+	}
+
+	for _, test := range tests {
+		excludes := NewExcludes(excludePresets[test.preset]...)
+		if got := excludes.Match(test.path, test.isDir); got != test.want {
+			t.Errorf("preset %s: Match(%q, %v) = %v, want %v", test.preset, test.path, test.isDir, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+)
+
+// Priority patterns (same syntax as excludes) mark changes that are sent before the rest, e.g. sources
+// before regenerated assets: "priority = src/**,*.go". Changes of every batch (an aggregateDirs window
+// or compacted queue) are written to the log in the order: deletions, priority changes, the rest.
+// Deletions go first, so that a path deleted and created again in the same batch is not deleted after it.
+
+// priorityPaths are nil when priority is not set
+var priorityPaths *Excludes
+
+// parsePriority parses patterns separated by "," or "|"
+func parsePriority(value string) *Excludes {
+	patterns := strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '|' })
+	for i := range patterns {
+		patterns[i] = strings.TrimSpace(patterns[i])
+	}
+	priority := NewExcludes(patterns...)
+	if len(priority.Patterns()) == 0 {
+		return nil
+	}
+	return priority
+}
+
+// prioritize splits changes into the ones that must be sent first and the rest, preserving their order
+func prioritize(changes []fileChange) (first []fileChange, rest []fileChange) {
+	if priorityPaths == nil {
+		return nil, changes
+	}
+
+	var priority []fileChange
+	for _, change := range changes {
+		if change.stat == nil {
+			first = append(first, change)
+		} else if priorityPaths.MatchChange(change.file, change.stat) {
+			priority = append(priority, change)
+		} else {
+			rest = append(rest, change)
+		}
+	}
+	return append(first, priority...), rest
+}
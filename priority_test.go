@@ -0,0 +1,75 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePriority(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{"", nil},
+		{" , | ", nil},
+		{"src/**,*.go", []string{"src/**", "*.go"}},
+		{" docs | *.md ", []string{"docs", "*.md"}},
+	}
+
+	for _, test := range tests {
+		var got []string
+		if priority := parsePriority(test.value); priority != nil {
+			got = priority.Patterns()
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parsePriority(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestPrioritize(t *testing.T) {
+	oldPriority := priorityPaths
+	defer func() { priorityPaths = oldPriority }()
+
+	file := &UnrealStat{mode: 0644}
+	dir := &UnrealStat{isDir: true, mode: 0755}
+	changes := []fileChange{
+		{"assets", dir},
+		{"assets/app.js", file},
+		{"main.go", file},
+		{"old.go", nil},
+		{"src", dir},
+		{"src/a.c", file},
+		{"tmp", nil},
+		{"vendor/x.go", file},
+	}
+	names := func(changes []fileChange) (result []string) {
+		for _, change := range changes {
+			result = append(result, change.file)
+		}
+		return
+	}
+
+	tests := []struct {
+		priority  string
+		wantFirst []string
+		wantRest  []string
+	}{
+		{"", nil, names(changes)},
+		{"*.go", []string{"old.go", "tmp", "main.go", "vendor/x.go"}, []string{"assets", "assets/app.js", "src", "src/a.c"}},
+		{"src/**, !vendor", []string{"old.go", "tmp", "src/a.c"}, []string{"assets", "assets/app.js", "main.go", "src", "vendor/x.go"}},
+		{"/src", []string{"old.go", "tmp", "src", "src/a.c"}, []string{"assets", "assets/app.js", "main.go", "vendor/x.go"}},
+		{"nothing", []string{"old.go", "tmp"}, []string{"assets", "assets/app.js", "main.go", "src", "src/a.c", "vendor/x.go"}},
+	}
+
+	for _, test := range tests {
+		priorityPaths = parsePriority(test.priority)
+		first, rest := prioritize(changes)
+		if got := names(first); !reflect.DeepEqual(got, test.wantFirst) {
+			t.Errorf("prioritize() with %q: first %q, want %q", test.priority, got, test.wantFirst)
+		}
+		if got := names(rest); !reflect.DeepEqual(got, test.wantRest) {
+			t.Errorf("prioritize() with %q: rest %q, want %q", test.priority, got, test.wantRest)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// transferProgress tracks bytes of a long transfer (big file or initial sync) for the status line
+type transferProgress struct {
+	sync.Mutex
+	active  bool
+	name    string
+	done    int64
+	total   int64 // 0 if unknown
+	base    int64 // bytes that were already transferred when we started, e.g. for resumed big files
+	started time.Time
+}
+
+func (p *transferProgress) start(name string, done, total int64) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.active = true
+	p.name = name
+	p.done = done
+	p.total = total
+	p.base = done
+	p.started = time.Now()
+}
+
+func (p *transferProgress) add(n int64) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.active {
+		p.done += n
+	}
+}
+
+func (p *transferProgress) set(done, total int64) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.active {
+		p.done = done
+		p.total = total
+	}
+}
+
+func (p *transferProgress) finish() {
+	p.Lock()
+	defer p.Unlock()
+
+	p.active = false
+}
+
+// String returns e.g. "big.iso 45% 12 MiB/s ETA 23s" or empty string if nothing is transferred
+func (p *transferProgress) String() string {
+	p.Lock()
+	defer p.Unlock()
+
+	if !p.active {
+		return ""
+	}
+
+	result := p.name
+	if result != "" {
+		result += " "
+	}
+
+	elapsed := time.Since(p.started).Seconds()
+	var speed float64
+	if elapsed > 0 {
+		speed = float64(p.done-p.base) / elapsed
+	}
+
+	if p.total > 0 {
+		result += fmt.Sprintf("%d%% ", p.done*100/p.total)
+	} else {
+		result += formatLength(int(p.done)) + " "
+	}
+	result += formatLength(int(speed)) + "/s"
+
+	if p.total > 0 && speed > 0 {
+		eta := time.Duration(float64(p.total-p.done)/speed) * time.Second
+		result += " ETA " + eta.String()
+	}
+	return result
+}
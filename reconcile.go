@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Reconciliation compares local repository with the one on the server level by level:
+// we request listings (names and hashes) of the directories whose hashes differ and descend
+// only into subdirectories that are different, so the cost is proportional to the size of
+// the difference instead of the size of the tree. Differences are sent directly to the server
+// bypassing out.log.
+
+const reconcileBatchSize = 1000
+
+type (
+	remoteEntry struct {
+		kind byte
+		hash string
+	}
+
+	remoteDir struct {
+		exists  bool
+		hash    string
+		entries map[string]remoteEntry
+	}
+)
+
+// reconcileThread brings server in sync with the local repository and then starts streaming changes.
+// If verify-interval is set it also periodically requests doSendChanges to check that server did not
+// drift away: verification must not send files at the same time with the log and the big files lane
+func (r *Client) reconcileThread() {
+	if !r.reconcile() {
+		sendErrorNonBlocking(r.errorCh, errors.New("Reconciliation with "+r.settings.host+" failed"))
+		return
+	}
+	r.setSynced(true)
+	go doSendChanges(r.stream, r)
+
+	if r.settings.verifyInterval == 0 {
+		return
+	}
+	for {
+		select {
+		case <-r.stopCh:
+			return
+		case <-time.After(r.settings.verifyInterval):
+			select {
+			case r.verifyCh <- true:
+			default:
+				// previous verification is not started yet
+			}
+		}
+	}
+}
+
+// verify reconciles with the server in between of log entries when big files lane is idle
+func (r *Client) verify() error {
+	if !r.bigFiles.wait(func() bool { return !r.bigFiles.idle() }, r.stopCh) {
+		return errors.New("Stopped while waiting for big files of " + r.settings.host)
+	}
+	if !r.reconcile() {
+		return errors.New("Verification of " + r.settings.host + " failed")
+	}
+	return nil
+}
+
+func (r *Client) reconcile() (ok bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			progressLn("Reconciliation with ", r.settings.host, " stopped: ", err)
+			ok = false
+		}
+	}()
+
+	<-repoReady
+	progressLn("Reconciling with " + r.settings.host + "...")
+
+	r.syncProgress.start("", 0, 0)
+	defer r.syncProgress.finish()
+
+	diff := r.newDiffWriter()
+	changesCount := 0
+	level := []string{"."}
+	for len(level) > 0 {
+		var next []string
+		for start := 0; start < len(level); start += reconcileBatchSize {
+			end := start + reconcileBatchSize
+			if end > len(level) {
+				end = len(level)
+			}
+
+			changes, dirs := compareWithRemote(level[start:end], r.requestTree(level[start:end]), r.isExcluded)
+			for _, change := range changes {
+				debugLn("Reconcile ", r.settings.host, ": ", change.file)
+				diff.Add(change.file, change.stat)
+			}
+			diff.Commit()
+			changesCount += len(changes)
+			next = append(next, dirs...)
+		}
+		level = next
+	}
+
+	progressLn("Reconciled with ", r.settings.host, ", sent ", changesCount, " changes")
+	return true
+}
+
+// compareWithRemote returns changes required to make remote dirs equal to local ones and
+// the list of subdirectories that exist on both sides but have different contents.
+// Paths excluded by the server's own rules are neither sent nor deleted. Hashes of directories
+// that contain such paths never match, so these directories are always compared entry by entry
+func compareWithRemote(dirs []string, remote map[string]*remoteDir, excluded func(file string, stat *UnrealStat) bool) (changes []fileChange, differentDirs []string) {
+	repo.Lock()
+	defer repo.Unlock()
+
+	for _, dir := range dirs {
+		local := repo.GetDirStat(dir)
+		remoteInfo, ok := remote[dir]
+		if !ok || !remoteInfo.exists {
+			remoteInfo = &remoteDir{entries: make(map[string]remoteEntry)}
+		} else if remoteInfo.hash == repo.DirHash(dir) {
+			continue
+		}
+
+		// deletions go first because otherwise change from dir to file will be impossible
+		for name := range remoteInfo.entries {
+			if _, ok := local[name]; !ok && !excluded(filepath.Join(dir, name), nil) {
+				changes = append(changes, fileChange{filepath.Join(dir, name), nil})
+			}
+		}
+
+		for name, stat := range local {
+			file := filepath.Join(dir, name)
+			if excluded(file, stat) {
+				continue
+			}
+			entry, ok := remoteInfo.entries[name]
+			if ok && entry.kind == stat.Kind() && entry.hash == repo.EntryHash(file, stat) {
+				continue
+			}
+
+			statCopy := *stat
+			changes = append(changes, fileChange{file, &statCopy})
+			if !stat.isDir {
+				continue
+			}
+			if ok && entry.kind == stat.Kind() {
+				differentDirs = append(differentDirs, file)
+			} else {
+				changes = appendSubtree(changes, file, excluded)
+			}
+		}
+	}
+	return
+}
+
+func appendSubtree(changes []fileChange, dir string, excluded func(file string, stat *UnrealStat) bool) []fileChange {
+	for name, stat := range repo.GetDirStat(dir) {
+		file := filepath.Join(dir, name)
+		if excluded(file, stat) {
+			continue
+		}
+		statCopy := *stat
+		changes = append(changes, fileChange{file, &statCopy})
+		if stat.isDir {
+			changes = appendSubtree(changes, file, excluded)
+		}
+	}
+	return changes
+}
+
+func (r *Client) requestTree(dirs []string) map[string]*remoteDir {
+	remoteDirs := r.remoteDirs(dirs)
+	r.sendToServer(actionTreeRequest, []byte(strings.Join(remoteDirs, "\n")))
+
+	var reply []byte
+	select {
+	case reply = <-r.treeCh:
+	case <-r.stopCh:
+		panic("Stopped while waiting for tree from " + r.settings.host)
+	}
+
+	return r.localTree(dirs, remoteDirs, parseTreeReply(reply))
+}
+
+// Tree reply consists of lines "<kind> <hash> <name>": each requested dir starts with
+// kind "=" (or "!" if there is no such directory) and is followed by its entries
+func parseTreeReply(reply []byte) map[string]*remoteDir {
+	result := make(map[string]*remoteDir)
+	var current *remoteDir
+
+	for _, line := range strings.Split(string(reply), "\n") {
+		if line == "" {
+			continue
+		}
+
+		parts := strings.SplitN(line, " ", 3)
+		if len(parts) != 3 {
+			panic("Malformed tree reply line: " + line)
+		}
+
+		if parts[0] == "=" || parts[0] == "!" {
+			current = &remoteDir{exists: parts[0] == "=", hash: parts[1], entries: make(map[string]remoteEntry)}
+			result[parts[2]] = current
+		} else if current != nil {
+			current.entries[parts[2]] = remoteEntry{parts[0][0], parts[1]}
+		} else {
+			panic("Tree reply entry without directory: " + line)
+		}
+	}
+
+	return result
+}
+
+// newDiffWriter returns writer that sends diffs and big files directly to the server
+func (r *Client) newDiffWriter() *DiffWriter {
+	write := func(action string, buf []byte) {
+		if buf = r.remoteDiff(buf); len(buf) > 0 {
+			r.sendToServer(action, buf)
+		}
+	}
+	return &DiffWriter{write: write, bigFile: r.commitBigFile}
+}
+
+// sendToServer writes action directly into ssh stdin of the server
+func (r *Client) sendToServer(action string, buf []byte) {
+	frame := make([]byte, 0, 20+len(buf))
+	frame = append(append(append(frame, action...), fmt.Sprintf("%10d", len(buf))...), buf...)
+	bufBlocker := BufBlocker{buf: frame, sent: make(chan bool)}
+	select {
+	case r.stream <- bufBlocker:
+	case <-r.stopCh:
+		panic("Stopped while sending to " + r.settings.host)
+	}
+	select {
+	case <-bufBlocker.sent:
+	case <-r.stopCh:
+		panic("Stopped while sending to " + r.settings.host)
+	}
+	r.syncProgress.add(int64(len(buf)))
+}
+
+// processTreeRequest replies with listings of the requested dirs. Server repository is built
+// on the first request and is kept up to date by the applied diffs after that. Every reconciliation
+// starts with the root directory, so the tree is rescanned then to see changes made on the server directly
+func processTreeRequest(buf []byte) {
+	dirs := strings.Split(string(buf), "\n")
+	if repo == nil {
+		progressLn("Building repository for reconciliation")
+		repo = NewRepository(serverExcludes)
+		repo.Lock()
+		syncTree(".", false)
+		repo.Unlock()
+	} else if len(dirs) == 1 && dirs[0] == "." {
+		debugLn("Rescanning repository for reconciliation")
+		repo.Lock()
+		syncTree(".", false)
+		repo.Unlock()
+	}
+
+	var reply bytes.Buffer
+	for _, dir := range dirs {
+		stats := repo.GetDirStat(dir)
+		if stats == nil {
+			fmt.Fprintf(&reply, "! - %s\n", dir)
+			continue
+		}
+
+		fmt.Fprintf(&reply, "= %s %s\n", repo.DirHash(dir), dir)
+		for name, stat := range stats {
+			fmt.Fprintf(&reply, "%c %s %s\n", stat.Kind(), repo.EntryHash(filepath.Join(dir, name), stat), name)
+		}
+	}
+
+	writeToClient(actionTreeReply, reply.Bytes())
+}
+
+// updateServerRepo refreshes repository entry of the file that was just changed by a diff
+func updateServerRepo(file string) {
+	if repo == nil {
+		return
+	}
+
+	// diff entries are applied in parallel
+	repo.Lock()
+	defer repo.Unlock()
+
+	info, err := os.Lstat(file)
+	if err != nil {
+		repo.Update(file, nil)
+		return
+	}
+
+	stat := UnrealStatFromStat(file, info)
+	repo.Update(file, &stat)
+}
@@ -1,19 +1,87 @@
 package main
 
-import "strings"
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
 
 type Repository struct {
-	stats    map[string]map[string]*UnrealStat
-	excludes map[string]bool
+	sync.Mutex
+	stats     map[string]map[string]*UnrealStat
+	dirHashes map[string]string
+	excludes  *Excludes
+	changed   bool
+
+	// rules from ignore files by directory, see LoadIgnoreFiles. Guarded by its own mutex
+	// because paths are checked by the watcher and by scan workers
+	ignores      map[string]*Excludes
+	ignoresMutex sync.RWMutex
+
+	skipped skipReporter
+
+	// files that were sent to servers by their content hash, see DiffWriter.addCopy
+	contents map[string][]contentSource
 }
 
-func NewRepository(excludes map[string]bool) *Repository {
+type contentSource struct {
+	file  string
+	mtime int64
+	size  int64
+}
+
+// maxContentSources limits number of files with the same contents that are remembered
+const maxContentSources = 4
+
+func NewRepository(excludes *Excludes) *Repository {
 	return &Repository{
-		stats:    make(map[string]map[string]*UnrealStat),
-		excludes: excludes,
+		stats:     make(map[string]map[string]*UnrealStat),
+		dirHashes: make(map[string]string),
+		excludes:  excludes,
+		contents:  make(map[string][]contentSource),
+		ignores:   make(map[string]*Excludes),
 	}
 }
 
+// AddContent remembers that file with the given contents hash was sent
+func (r *Repository) AddContent(hash string, file string, stat *UnrealStat) {
+	sources := []contentSource{{file, stat.mtime, stat.size}}
+	for _, source := range r.contents[hash] {
+		if source.file != file && len(sources) < maxContentSources {
+			sources = append(sources, source)
+		}
+	}
+	r.contents[hash] = sources
+}
+
+// FindContent returns another file that was sent with the same contents and has not changed since then
+func (r *Repository) FindContent(hash string, file string) (string, bool) {
+	sources := r.contents[hash]
+	valid := sources[:0]
+	result := ""
+
+	for _, source := range sources {
+		stat, ok := r.GetDirStat(filepath.Dir(source.file))[filepath.Base(source.file)]
+		if !ok || stat.isDir || stat.isLink || stat.mtime != source.mtime || stat.size != source.size {
+			continue
+		}
+		valid = append(valid, source)
+		if result == "" && source.file != file {
+			result = source.file
+		}
+	}
+
+	if len(valid) == 0 {
+		delete(r.contents, hash)
+	} else {
+		r.contents[hash] = valid
+	}
+	return result, result != ""
+}
+
 func (r *Repository) HasDir(dir string) bool {
 	_, ok := r.stats[dir]
 	return ok
@@ -21,6 +89,7 @@ func (r *Repository) HasDir(dir string) bool {
 
 func (r *Repository) AddDir(dir string) {
 	r.stats[dir] = make(map[string]*UnrealStat)
+	r.invalidate(dir)
 }
 
 func (r *Repository) GetDirStat(dir string) map[string]*UnrealStat {
@@ -34,20 +103,111 @@ func (r *Repository) GetDirStat(dir string) map[string]*UnrealStat {
 
 func (r *Repository) SetDirStat(dir string, stat map[string]*UnrealStat) {
 	r.stats[dir] = stat
+	r.invalidate(dir)
 }
 
 func (r *Repository) AddFileToDir(dir, file string, stat *UnrealStat) {
 	r.stats[dir][file] = stat
+	r.invalidate(dir)
+}
+
+// RemoveDir forgets dir and everything below it
+func (r *Repository) RemoveDir(dir string) {
+	for name := range r.stats {
+		if name == dir || strings.HasPrefix(name, dir+"/") {
+			delete(r.stats, name)
+			delete(r.dirHashes, name)
+		}
+	}
+	r.invalidate(filepath.Dir(dir))
 }
 
-func (r *Repository) IsPathExcluded(path string) bool {
-	if strings.HasPrefix(path, ".unrealsync") { // todo: don't we have it in excludes always?
+// Update records stat of the file that was just written (nil stat means that file was deleted)
+func (r *Repository) Update(file string, stat *UnrealStat) {
+	file = filepath.Clean(file)
+	dir, name := filepath.Dir(file), filepath.Base(file)
+	if old, ok := r.stats[dir][name]; ok && old.isDir && (stat == nil || !stat.isDir) {
+		r.RemoveDir(file)
+	}
+
+	if stat == nil {
+		if r.HasDir(dir) {
+			delete(r.stats[dir], name)
+			r.invalidate(dir)
+		}
+		return
+	}
+
+	if !r.HasDir(dir) {
+		r.AddDir(dir)
+	}
+	r.AddFileToDir(dir, name, stat)
+	if stat.isDir && !r.HasDir(file) {
+		r.AddDir(file)
+	}
+}
+
+// invalidate drops cached hashes of dir and all of its parents
+func (r *Repository) invalidate(dir string) {
+	r.changed = true
+	for {
+		delete(r.dirHashes, dir)
+		if dir == "." || dir == "/" {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// DirHash returns hash that covers names and stats of everything below dir,
+// so two repositories have equal subtrees if and only if their hashes are equal
+func (r *Repository) DirHash(dir string) string {
+	if hash, ok := r.dirHashes[dir]; ok {
+		return hash
+	}
+
+	stats := r.stats[dir]
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := newHash()
+	for _, name := range names {
+		io.WriteString(h, name+"\x00"+r.EntryHash(filepath.Join(dir, name), stats[name])+"\n")
+	}
+	hash := fmt.Sprintf("%x", h.Sum(nil))
+	r.dirHashes[dir] = hash
+	return hash
+}
+
+// EntryHash returns hash of a stat, for directories it also covers their contents
+func (r *Repository) EntryHash(file string, stat *UnrealStat) string {
+	h := newHash()
+	io.WriteString(h, stat.Fingerprint())
+	if stat.isDir {
+		io.WriteString(h, " "+r.DirHash(file))
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func (r *Repository) IsPathExcluded(path string, isDir bool) bool {
+	if path == ".unrealsync" || strings.HasPrefix(path, ".unrealsync/") {
+		return true
+	}
+	if !r.excludes.Allows(path, isDir) {
 		return true
 	}
-	for exclude := range r.excludes {
-		if strings.HasPrefix(path, exclude) {
+	for i := 0; i < len(path); i++ {
+		if path[i] == '/' && r.isExcludedItself(path[:i], true) {
 			return true
 		}
 	}
-	return false
+	return r.isExcludedItself(path, isDir)
+}
+
+func (r *Repository) isExcludedItself(path string, isDir bool) bool {
+	excluded, _ := r.excludes.match(path, isDir)
+	return r.isIgnored(path, isDir, excluded)
 }
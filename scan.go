@@ -0,0 +1,162 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// Initial walk of a big tree is dominated by directory reads and, with --hash-check, by hashing.
+// scanTree does both on a pool of workers before syncDir walks the tree, so that syncDir itself
+// stays serial and produces exactly the same result, but takes listings and hashes from memory.
+
+var scanWorkers = runtime.NumCPU() * 2
+
+type treeScan struct {
+	sync.Mutex
+	listings map[string][]os.FileInfo
+	hashes   map[string]string
+
+	// queue of directories to read
+	cond   *sync.Cond
+	queue  []string
+	active int
+}
+
+// scanned contains results of the last scanTree, it is consumed by syncDir
+var scanned *treeScan
+
+// syncTree is syncDir(dir, true, sendChanges) that reads directories and hashes files in parallel.
+// Must be called with repo locked
+func syncTree(dir string, sendChanges bool) {
+	scanned = scanTree(repo.excludes.sparseRoots(dir), !sendChanges)
+	syncDir(dir, true, sendChanges)
+	scanned = nil
+}
+
+// scanTree reads all directories under roots. If hashAll is set, all changed files are hashed
+// (as syncDir does when initializing repository), otherwise only files that need hash for comparison
+func scanTree(roots []string, hashAll bool) *treeScan {
+	scan := &treeScan{
+		listings: make(map[string][]os.FileInfo),
+		hashes:   make(map[string]string),
+		queue:    roots,
+	}
+	scan.cond = sync.NewCond(&scan.Mutex)
+
+	var wg sync.WaitGroup
+	for i := 0; i < scanWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				dir, ok := scan.next()
+				if !ok {
+					return
+				}
+				scan.readDir(dir, hashAll)
+				scan.done()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return scan
+}
+
+func (s *treeScan) next() (string, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	for len(s.queue) == 0 && s.active > 0 {
+		s.cond.Wait()
+	}
+	if len(s.queue) == 0 {
+		return "", false
+	}
+
+	dir := s.queue[len(s.queue)-1]
+	s.queue = s.queue[:len(s.queue)-1]
+	s.active++
+	return dir, true
+}
+
+func (s *treeScan) done() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.active--
+	s.cond.Broadcast()
+}
+
+func (s *treeScan) readDir(dir string, hashAll bool) {
+	if dir == ".unrealsync" {
+		return
+	}
+
+	fp, err := os.Open(dir)
+	if err != nil {
+		// syncDir reports errors
+		return
+	}
+	infos, err := fp.Readdir(-1)
+	fp.Close()
+	if err != nil {
+		return
+	}
+
+	// rules of dir must be known before its entries and subdirectories are checked
+	repo.LoadIgnoreFiles(dir)
+
+	// repo is locked by the caller of syncTree and is not changed until scan is finished
+	repoInfo := repo.stats[dir]
+	var subdirs []string
+	hashes := make(map[string]string)
+
+	for _, info := range infos {
+		filePath := filepath.Join(dir, info.Name())
+		if repo.IsPathExcluded(filePath, info.IsDir()) {
+			continue
+		}
+
+		if info.IsDir() {
+			subdirs = append(subdirs, filePath)
+		} else if hashCheck && info.Mode().IsRegular() && repo.excludes.Skips(filePath, info.Mode(), info.Size()) == "" {
+			// same conditions as in syncDir: hash is needed for new files when initializing repository
+			// and for files with changed mtime when comparing them with repository
+			repoEl, ok := repoInfo[info.Name()]
+			if hashAll && (!ok || repoEl.size != info.Size() || repoEl.mtime != info.ModTime().Unix()) ||
+				ok && repoEl.size == info.Size() && repoEl.mtime != info.ModTime().Unix() {
+				if hash, err := computeHash(filePath); err == nil {
+					hashes[filePath] = hash
+				}
+			}
+		}
+	}
+
+	s.Lock()
+	s.listings[dir] = infos
+	for file, hash := range hashes {
+		s.hashes[file] = hash
+	}
+	s.queue = append(s.queue, subdirs...)
+	s.cond.Broadcast()
+	s.Unlock()
+}
+
+// listing returns directory contents read by scanTree if any
+func (s *treeScan) listing(dir string) ([]os.FileInfo, bool) {
+	if s == nil {
+		return nil, false
+	}
+	infos, ok := s.listings[dir]
+	return infos, ok
+}
+
+func (s *treeScan) hash(file string) string {
+	if s == nil {
+		return ""
+	}
+	return s.hashes[file]
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func writeTestTree(t *testing.T, files map[string]string) {
+	for file, contents := range files {
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// syncTestRepo syncs the current directory into r serially or with syncTree and returns sorted pending changes
+func syncTestRepo(r *Repository, parallel bool, sendChanges bool) []fileChange {
+	repo, pendingChanges = r, nil
+	repo.Lock()
+	if parallel {
+		syncTree(".", sendChanges)
+	} else {
+		syncDir(".", true, sendChanges)
+	}
+	repo.Unlock()
+
+	changes := pendingChanges
+	pendingChanges = nil
+	sort.Slice(changes, func(i, j int) bool { return changes[i].file < changes[j].file })
+	return changes
+}
+
+func TestSyncTreeSameAsSyncDir(t *testing.T) {
+	oldRepo, oldHashCheck := repo, hashCheck
+	defer func() { repo, hashCheck, pendingChanges = oldRepo, oldHashCheck, nil }()
+
+	for _, hashCheck = range []bool{false, true} {
+		t.Run(map[bool]string{false: "mtime", true: "hash"}[hashCheck], func(t *testing.T) {
+			chdirTemp(t)
+			writeTestTree(t, map[string]string{
+				"a.txt":                 "a",
+				"same.txt":              "same",
+				"dir/b.txt":             "b",
+				"dir/sub/c.txt":         "c",
+				"dir/sub/deep/d.txt":    "d",
+				"dir/.unrealsyncignore": "*.log\n!keep.log\ngen/\n",
+				"dir/x.log":             "x",
+				"dir/keep.log":          "keep",
+				"dir/gen/e.txt":         "e",
+				"excluded/f.txt":        "f",
+				"other/g.txt":           "g",
+			})
+			if err := os.Symlink("a.txt", "dir/link"); err != nil {
+				t.Fatal(err)
+			}
+
+			serial, parallel := NewRepository(NewExcludes("excluded")), NewRepository(NewExcludes("excluded"))
+			syncTestRepo(serial, false, false)
+			syncTestRepo(parallel, true, false)
+			if !reflect.DeepEqual(parallel.stats, serial.stats) {
+				t.Fatalf("initial scan: syncTree() = %v, syncDir() = %v", parallel.stats, serial.stats)
+			}
+
+			// additions, deletions, changes of contents and mtime-only changes
+			writeTestTree(t, map[string]string{"dir/sub/new.txt": "new", "a.txt": "changed", "other/h/i.txt": "i"})
+			for _, file := range []string{"dir/b.txt", "dir/sub/deep/d.txt"} {
+				if err := os.Remove(file); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.RemoveAll("dir/sub/deep"); err != nil {
+				t.Fatal(err)
+			}
+			mtime := time.Now().Add(-time.Hour)
+			if err := os.Chtimes("same.txt", mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+
+			serialChanges := syncTestRepo(serial, false, true)
+			parallelChanges := syncTestRepo(parallel, true, true)
+			if len(serialChanges) == 0 {
+				t.Fatalf("syncDir() found no changes")
+			}
+			if !reflect.DeepEqual(parallelChanges, serialChanges) {
+				t.Errorf("changes: syncTree() = %v, syncDir() = %v", parallelChanges, serialChanges)
+			}
+			if !reflect.DeepEqual(parallel.stats, serial.stats) {
+				t.Errorf("after changes: syncTree() = %v, syncDir() = %v", parallel.stats, serial.stats)
+			}
+		})
+	}
+}
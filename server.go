@@ -1,10 +1,11 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
 	"crypto/md5"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/signal"
 	"path"
@@ -12,6 +13,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -23,80 +25,49 @@ type (
 	}
 )
 
-func applyDiff(buf []byte) {
-	var (
-		sepBytes = []byte(diffSep)
-		offset   = 0
-		endPos   = 0
-	)
-
-	dirs := make(map[string]map[string]*UnrealStat)
-
-	for {
-		if offset >= len(buf)-1 {
-			break
-		}
-
-		if endPos = bytes.Index(buf[offset:], sepBytes); endPos < 0 {
-			break
-		}
-
-		endPos += offset
-		chunk := buf[offset:endPos]
-		offset = endPos + len(sepBytes)
-		op := chunk[0]
-
-		var (
-			diffstat UnrealStat
-			file     []byte
-			contents []byte
-		)
-
-		if op == 'A' {
-			firstLinePos := bytes.IndexByte(chunk, '\n')
-			if firstLinePos < 0 {
-				fatalLn("No new line in file diff: ", string(chunk))
-			}
-
-			file = chunk[2:firstLinePos]
-			diffstat = UnrealStatUnserialize(string(chunk[firstLinePos+1:]))
-		} else if op == 'D' {
-			file = chunk[2:]
-		} else {
-			fatalLn("Unknown operation in diff: ", op)
-		}
+var (
+	serverExcludes *Excludes
+	stdoutMutex    sync.Mutex
+)
 
-		// TODO: path check
+// writeToClient sends action to the client. Payload (if any) is prefixed with its length
+func writeToClient(action string, payload []byte) {
+	stdoutMutex.Lock()
+	defer stdoutMutex.Unlock()
 
-		if op == 'A' && !diffstat.isDir && diffstat.size > 0 {
-			contents = buf[offset : offset+int(diffstat.size)]
-			offset += int(diffstat.size)
-		}
-
-		fileStr := string(file)
-		dir := path.Dir(fileStr)
+	if payload == nil {
+		os.Stdout.Write([]byte(action))
+		return
+	}
+	fmt.Fprintf(os.Stdout, "%s%10d%s", action, len(payload), payload)
+}
 
-		if dirs[dir] == nil {
-			dirs[dir] = make(map[string]*UnrealStat)
+// applyEntry applies a single entry of diff, see applyDiff. Contents of a file are already received
+// into tmpName (see receiveFile), contents of a symlink is its target
+func applyEntry(entry diffEntry, tmpName string, target []byte) {
+	file := mapPath(entry.file)
+	if entry.op == 'A' {
+		writeContents(file, entry.stat, tmpName, target)
+		updateServerRepo(entry.file)
+	} else if entry.op == 'C' {
+		if !copyContents(file, entry.stat, entry.ref) {
+			writeToClient(actionCopyMiss, []byte(entry.file))
 		}
-
-		if op == 'A' {
-			writeContents(fileStr, diffstat, contents)
-			dirs[dir][path.Base(fileStr)] = &diffstat
-		} else if op == 'D' {
-			err := os.RemoveAll(string(file))
-			if err != nil {
-				// TODO: better error handling than just print :)
-				progressLn("Cannot remove ", string(file))
-			}
-			dirs[dir][path.Base(fileStr)] = nil
-		} else {
-			fatalLn("Unknown operation in diff:", op)
+		updateServerRepo(entry.file)
+	} else if entry.op == 'D' {
+		err := os.RemoveAll(file)
+		if err != nil {
+			// TODO: better error handling than just print :)
+			progressLn("Cannot remove ", file)
 		}
+		updateServerRepo(entry.file)
+	} else {
+		fatalLn("Unknown operation in diff:", entry.op)
 	}
 }
 
-func readResponse(inStream io.ReadCloser) []byte {
+// readLength reads length of the action payload
+func readLength(inStream io.Reader) int {
 	lengthBytes := make([]byte, 10)
 
 	if _, err := io.ReadFull(inStream, lengthBytes); err != nil {
@@ -108,15 +79,18 @@ func readResponse(inStream io.ReadCloser) []byte {
 		panic("Incorrect diff length in applyThread from " + hostname + ": " + err.Error())
 	}
 
+	if length > maxDiffSize {
+		panic("Too big diff from " + hostname + ", probably communication error")
+	}
+	return length
+}
+
+func readResponse(inStream io.Reader, length int) []byte {
 	buf := make([]byte, length)
 	if length == 0 {
 		return buf
 	}
 
-	if length > maxDiffSize {
-		panic("Too big diff from " + hostname + ", probably communication error")
-	}
-
 	if _, err := io.ReadFull(inStream, buf); err != nil {
 		panic("Cannot read diff from " + hostname)
 	}
@@ -124,13 +98,14 @@ func readResponse(inStream io.ReadCloser) []byte {
 	return buf
 }
 
-func applyThread(inStream io.ReadCloser) {
+func applyThread(stdin io.ReadCloser) {
+	inStream := bufio.NewReader(stdin)
 	bigFps := make(map[string]BigFile)
 
 	defer func() {
+		// partially received big files are kept to resume them after reconnect
 		for _, bigFile := range bigFps {
 			bigFile.fp.Close()
-			os.Remove(bigFile.tmpName)
 		}
 
 		if r := recover(); r != nil {
@@ -154,12 +129,17 @@ func applyThread(inStream io.ReadCloser) {
 		debugLn("Received ", "'"+actionStr+"' mem.Sys:", formatLength(int(mem.Sys)))
 		rcvchan <- true
 
-		buf := readResponse(inStream)
+		length := readLength(inStream)
+		if actionStr == actionDiff {
+			// diffs are applied while they are read, other actions are small enough to be read into memory
+			applyRemoteDiff(inStream, length)
+			continue
+		}
+
+		buf := readResponse(inStream, length)
 
 		if actionStr == actionPing {
-			os.Stdout.Write([]byte(actionPong))
-		} else if actionStr == actionDiff {
-			applyRemoteDiff(buf)
+			writeToClient(actionPong, nil)
 		} else if actionStr == actionBigInit {
 			processBigInit(buf, bigFps)
 		} else if actionStr == actionBigRcv {
@@ -168,6 +148,10 @@ func applyThread(inStream io.ReadCloser) {
 			processBigCommit(buf, bigFps)
 		} else if actionStr == actionBigAbort {
 			processBigAbort(buf, bigFps)
+		} else if actionStr == actionBigKeep {
+			processBigKeep(buf)
+		} else if actionStr == actionTreeRequest {
+			processTreeRequest(buf)
 		} else if actionStr == actionPong {
 		} else if actionStr == actionStopServer {
 		} else {
@@ -176,22 +160,118 @@ func applyThread(inStream io.ReadCloser) {
 	}
 }
 
-func tmpBigName(filename string) string {
+// Partially received big files are kept in repoBigTmp under the name that depends both on the file name
+// and on its stat, so that transfer can be resumed after reconnect only if the source file did not change
+func tmpBigPrefix(filename string) string {
 	h := md5.New()
 	io.WriteString(h, filename)
-	return path.Join(repoPath, repoTmp, "big_"+fmt.Sprintf("%x", h.Sum(nil)))
+	return path.Join(repoPathFor(mapPath(filename)), repoBigTmp, "big_"+fmt.Sprintf("%x", h.Sum(nil))+"_")
+}
+
+func tmpBigName(filename string, stat UnrealStat) string {
+	h := md5.New()
+	io.WriteString(h, stat.Serialize())
+	return tmpBigPrefix(filename) + fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// bigPartials contains names of partially received big files that are not being received right now
+var bigPartials = make(map[string]bool)
+
+// removeStaleBigFiles removes partially received big files that were not resumed for a long time
+func removeStaleBigFiles() {
+	matches, _ := filepath.Glob(path.Join(repoPath, repoBigTmp, "big_*"))
+	for _, m := range serverMappings {
+		mappedMatches, _ := filepath.Glob(path.Join(m.dir, defaultRepoDir, repoBigTmp, "big_*"))
+		matches = append(matches, mappedMatches...)
+	}
+	for _, name := range matches {
+		if stat, err := os.Stat(name); err == nil && time.Since(stat.ModTime()) > bigFileKeepTime {
+			os.Remove(name)
+		} else if err == nil {
+			bigPartials[name] = true
+		}
+	}
+}
+
+// removeBigPartials removes partially received versions of the file: it was replaced by something else
+func removeBigPartials(filename string) {
+	if len(bigPartials) == 0 {
+		return
+	}
+	prefix := tmpBigPrefix(filename)
+	for name := range bigPartials {
+		if strings.HasPrefix(name, prefix) {
+			os.Remove(name)
+			delete(bigPartials, name)
+		}
+	}
+}
+
+// processBigKeep receives newline-separated names of big files that client is going to resume after rsync,
+// all other partially received files were replaced by rsync
+func processBigKeep(buf []byte) {
+	keep := make(map[string]bool)
+	if len(buf) > 0 {
+		for _, filename := range strings.Split(string(buf), "\n") {
+			keep[tmpBigPrefix(filename)] = true
+		}
+	}
+
+	for name := range bigPartials {
+		// prefix is everything up to the stat hash, see tmpBigName
+		if !keep[name[:strings.LastIndex(name, "_")+1]] {
+			debugLn("Removing partially received big file ", name)
+			os.Remove(name)
+			delete(bigPartials, name)
+		}
+	}
 }
 
 func processBigInit(buf []byte, bigFps map[string]BigFile) {
-	filename := string(buf)
-	tmpName := tmpBigName(filename)
-	fp, err := os.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+	filename, stat := parseBigFilePayload(buf)
+	tmpName := tmpBigName(filename, stat)
+
+	if bigFile, ok := bigFps[filename]; ok {
+		bigFile.fp.Close()
+		delete(bigFps, filename)
+	}
+
+	// older versions of the file cannot be resumed anymore
+	matches, _ := filepath.Glob(tmpBigPrefix(filename) + "*")
+	for _, name := range matches {
+		if name != tmpName {
+			os.Remove(name)
+			delete(bigPartials, name)
+		}
+	}
+	delete(bigPartials, tmpName)
+
+	fp, err := os.OpenFile(tmpName, os.O_RDWR|os.O_CREATE, 0755)
 	if err != nil {
 		panic("Cannot open tmp file " + tmpName + ": " + err.Error())
 	}
 
+	fileStat, err := fp.Stat()
+	if err != nil {
+		panic("Cannot stat tmp file " + tmpName + ": " + err.Error())
+	}
+
+	offset := fileStat.Size()
+	if offset > stat.size {
+		if err = fp.Truncate(0); err != nil {
+			panic("Cannot truncate tmp file " + tmpName + ": " + err.Error())
+		}
+		offset = 0
+	}
+
+	if offset > 0 {
+		progressLn("Resuming big file ", filename, " from ", formatLength(int(offset)))
+	}
+
 	bigFps[filename] = BigFile{fp, tmpName}
+	writeToClient(actionBigHave, []byte(fmt.Sprintf("%010d%s%020d", len(filename), filename, offset)))
 }
+
 func processBigRcv(buf []byte, bigFps map[string]BigFile) {
 	bufOffset := 0
 
@@ -204,37 +284,43 @@ func processBigRcv(buf []byte, bigFps map[string]BigFile) {
 	filename := string(buf[bufOffset : bufOffset+int(filenameLen)])
 	bufOffset += int(filenameLen)
 
+	offset, err := strconv.ParseInt(string(buf[bufOffset:bufOffset+20]), 10, 64)
+	if err != nil {
+		panic("Cannot parse big chunk offset")
+	}
+	bufOffset += 20
+
 	bigFile, ok := bigFps[filename]
 	if !ok {
 		panic("Received big chunk for unknown file: " + filename)
 	}
 
-	if _, err = bigFile.fp.Write(buf[bufOffset:]); err != nil {
+	if _, err = bigFile.fp.WriteAt(buf[bufOffset:], offset); err != nil {
 		panic("Cannot write to tmp file " + bigFile.tmpName + ": " + err.Error())
 	}
 }
 
 func processBigCommit(buf []byte, bigFps map[string]BigFile) {
-	bufOffset := 0
-
-	filenameLen, err := strconv.ParseInt(string(buf[bufOffset:10]), 10, 32)
-	if err != nil {
-		panic("Cannot parse big filename length")
-	}
-
-	bufOffset += 10
-	filename := string(buf[bufOffset : bufOffset+int(filenameLen)])
-	bufOffset += int(filenameLen)
+	filename, bigstat := parseBigFilePayload(buf)
 
 	bigFile, ok := bigFps[filename]
 	if !ok {
 		panic("Received big commit for unknown file: " + filename)
 	}
+	delete(bigFps, filename)
 
-	bigstat := UnrealStatUnserialize(string(buf[bufOffset:]))
+	fileStat, err := bigFile.fp.Stat()
+	if err != nil {
+		panic("Cannot stat tmp file " + bigFile.tmpName + ": " + err.Error())
+	}
 	if err = bigFile.fp.Close(); err != nil {
 		panic("Cannot close tmp file " + bigFile.tmpName + ": " + err.Error())
 	}
+	if fileStat.Size() != bigstat.size {
+		os.Remove(bigFile.tmpName)
+		panic("Received " + strconv.FormatInt(fileStat.Size(), 10) + " bytes of " + filename +
+			" instead of " + strconv.FormatInt(bigstat.size, 10))
+	}
 
 	if err = os.Chmod(bigFile.tmpName, os.FileMode(bigstat.mode)); err != nil {
 		panic("Cannot chmod " + bigFile.tmpName + ": " + err.Error())
@@ -244,29 +330,36 @@ func processBigCommit(buf []byte, bigFps map[string]BigFile) {
 		panic("Cannot set mtime for " + bigFile.tmpName + ": " + err.Error())
 	}
 
-	os.MkdirAll(filepath.Dir(filename), 0755)
-	if err = os.Rename(bigFile.tmpName, filename); err != nil {
-		panic("Cannot rename " + bigFile.tmpName + " to " + filename + ": " + err.Error())
+	file := mapPath(filename)
+	os.MkdirAll(filepath.Dir(file), 0755)
+	if err = os.Rename(bigFile.tmpName, file); err != nil {
+		panic("Cannot rename " + bigFile.tmpName + " to " + file + ": " + err.Error())
 	}
+	updateServerRepo(filename)
 }
 
 func processBigAbort(buf []byte, bigFps map[string]BigFile) {
 	filename := string(buf)
 	bigFile, ok := bigFps[filename]
 	if !ok {
-		panic("Received big commit for unknown file: " + filename)
+		panic("Received big abort for unknown file: " + filename)
 	}
+	delete(bigFps, filename)
 
 	bigFile.fp.Close()
 	os.Remove(bigFile.tmpName)
 }
 
-func applyRemoteDiff(buf []byte) {
-	applyDiff(buf)
-	progressLn("Applied diff ", formatLength(len(buf)))
+func applyRemoteDiff(inStream io.Reader, length int) {
+	diff := &io.LimitedReader{R: inStream, N: int64(length)}
+	applyDiff(diff)
+	if _, err := io.Copy(ioutil.Discard, diff); err != nil {
+		panic("Cannot read diff from " + hostname + ": " + err.Error())
+	}
+	progressLn("Applied diff ", formatLength(length))
 }
 
-func writeContents(file string, unrealStat UnrealStat, contents []byte) {
+func writeContents(file string, unrealStat UnrealStat, tmpName string, target []byte) {
 	stat, err := os.Lstat(file)
 
 	if err == nil {
@@ -274,11 +367,13 @@ func writeContents(file string, unrealStat UnrealStat, contents []byte) {
 		if stat.IsDir() != unrealStat.isDir || stat.Mode()&os.ModeSymlink == os.ModeSymlink {
 			if err = os.RemoveAll(file); err != nil {
 				progressLn("Cannot remove ", file, ": ", err.Error())
+				removeTmpFile(tmpName)
 				return
 			}
 		}
 	} else if !os.IsNotExist(err) {
 		progressLn("Error doing lstat for ", file, ": ", err.Error())
+		removeTmpFile(tmpName)
 		return
 	}
 
@@ -292,51 +387,69 @@ func writeContents(file string, unrealStat UnrealStat, contents []byte) {
 			return
 		}
 	} else if unrealStat.isLink {
-		if err = os.Symlink(string(contents), file); err != nil {
+		if err = os.Symlink(string(target), file); err != nil {
 			progressLn("Cannot create symlink ", file, ": ", err.Error())
 			return
 		}
 	} else {
-		writeFile(file, unrealStat, contents)
+		writeFile(file, unrealStat, tmpName)
 	}
 }
 
-func writeFile(file string, unrealStat UnrealStat, contents []byte) {
-	tempnam := path.Join(repoPath, repoTmp, path.Base(file))
-
-	fp, err := os.OpenFile(tempnam, os.O_CREATE|os.O_TRUNC|os.O_RDWR, os.FileMode(unrealStat.mode))
+// receiveFile writes contents of the file into a temporary file and returns its name, or "" if it failed.
+// Contents are received while the diff is read, so the temporary file must be unique
+func receiveFile(file string, unrealStat UnrealStat, contents io.Reader) string {
+	fp, err := ioutil.TempFile(tmpDirFor(file), path.Base(file)+".")
 	if err != nil {
-		progressLn("Cannot open ", tempnam)
-		return
+		progressLn("Cannot create temporary file for ", file, ": ", err.Error())
+		return ""
 	}
+	tempnam := fp.Name()
 
-	if _, err = fp.Write(contents); err != nil {
+	n, err := io.Copy(fp, contents)
+	if closeErr := fp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || n != unrealStat.size {
 		// TODO: more accurate error handling
-		progressLn("Cannot write contents to ", tempnam, ": ", err.Error())
-		fp.Close()
+		progressLn("Cannot write contents to ", tempnam, ": ", err)
+		os.Remove(tempnam)
+		return ""
+	}
+	return tempnam
+}
+
+// removeTmpFile removes received contents that were not written to the file
+func removeTmpFile(tmpName string) {
+	if tmpName != "" {
+		os.Remove(tmpName)
+	}
+}
+
+// writeFile moves received contents of the file into place
+func writeFile(file string, unrealStat UnrealStat, tempnam string) {
+	if tempnam == "" {
 		return
 	}
 
-	if err = fp.Chmod(os.FileMode(unrealStat.mode)); err != nil {
+	if err := os.Chmod(tempnam, os.FileMode(unrealStat.mode)); err != nil {
 		progressLn("Cannot chmod ", tempnam, ": ", err.Error())
-		fp.Close()
+		os.Remove(tempnam)
 		return
 	}
 
-	fp.Close()
-
 	dir := path.Dir(file)
-	if err = os.MkdirAll(dir, 0755); err != nil {
+	if err := os.MkdirAll(dir, 0755); err != nil {
 		progressLn("Cannot create dir ", dir, ": ", err.Error())
 		os.Remove(tempnam)
 		return
 	}
 
-	if err = os.Chtimes(tempnam, time.Unix(unrealStat.mtime, 0), time.Unix(unrealStat.mtime, 0)); err != nil {
+	if err := os.Chtimes(tempnam, time.Unix(unrealStat.mtime, 0), time.Unix(unrealStat.mtime, 0)); err != nil {
 		progressLn("Failed to change modification time for ", file, ": ", err.Error())
 	}
 
-	if err = os.Rename(tempnam, file); err != nil {
+	if err := os.Rename(tempnam, file); err != nil {
 		progressLn("Cannot rename ", tempnam, " to ", file)
 		os.Remove(tempnam)
 		return
@@ -347,6 +460,74 @@ func writeFile(file string, unrealStat UnrealStat, contents []byte) {
 	}
 }
 
+// copyContents creates file from the local copy of source if it has the expected hash
+func copyContents(file string, unrealStat UnrealStat, ref string) bool {
+	parts := strings.SplitN(ref, " ", 2)
+	if len(parts) != 2 {
+		progressLn("Malformed copy reference for ", file, ": ", ref)
+		return false
+	}
+	expectedHash, source := parts[0], parts[1]
+	source = mapPath(source)
+
+	srcFp, err := os.Open(source)
+	if err != nil {
+		debugLn("Cannot open copy source ", source, ": ", err.Error())
+		return false
+	}
+	defer srcFp.Close()
+
+	fp, err := ioutil.TempFile(tmpDirFor(file), path.Base(file)+".")
+	if err != nil {
+		progressLn("Cannot create temporary file for ", file, ": ", err.Error())
+		return false
+	}
+	tempnam := fp.Name()
+
+	hash := newHash()
+	n, err := io.Copy(fp, io.TeeReader(srcFp, hash))
+	fp.Close()
+	if err != nil || n != unrealStat.size || encodeHash(hash) != expectedHash {
+		debugLn("Copy source ", source, " for ", file, " has different contents")
+		os.Remove(tempnam)
+		return false
+	}
+
+	if err = os.Chmod(tempnam, os.FileMode(unrealStat.mode)); err != nil {
+		progressLn("Cannot chmod ", tempnam, ": ", err.Error())
+		os.Remove(tempnam)
+		return false
+	}
+
+	if stat, err := os.Lstat(file); err == nil && (stat.IsDir() || stat.Mode()&os.ModeSymlink == os.ModeSymlink) {
+		if err = os.RemoveAll(file); err != nil {
+			progressLn("Cannot remove ", file, ": ", err.Error())
+			os.Remove(tempnam)
+			return false
+		}
+	}
+
+	dir := path.Dir(file)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		progressLn("Cannot create dir ", dir, ": ", err.Error())
+		os.Remove(tempnam)
+		return false
+	}
+
+	if err = os.Chtimes(tempnam, time.Unix(unrealStat.mtime, 0), time.Unix(unrealStat.mtime, 0)); err != nil {
+		progressLn("Failed to change modification time for ", file, ": ", err.Error())
+	}
+
+	if err = os.Rename(tempnam, file); err != nil {
+		progressLn("Cannot rename ", tempnam, " to ", file)
+		os.Remove(tempnam)
+		return false
+	}
+
+	debugLn("Copied ", file, " from ", source)
+	return true
+}
+
 func timeoutThread() {
 	for {
 		select {
@@ -359,11 +540,32 @@ func timeoutThread() {
 }
 
 func doServer() {
-	excludes := make(map[string]bool)
-	for _, dir := range excludesFlag {
-		excludes[dir] = true
+	var err error
+	if serverMappings, err = parseMappings(strings.Join(mapFlag, "|")); err != nil {
+		fatalLn("Cannot parse --map: ", err)
 	}
-	// todo we need to take this excludes into account further. THEY ARE NOT USED
+	for _, m := range serverMappings {
+		mappedRepoPath := filepath.Join(m.dir, defaultRepoDir)
+		os.RemoveAll(filepath.Join(mappedRepoPath, repoTmp))
+		for _, dir := range []string{repoTmp, repoBigTmp} {
+			if err = os.MkdirAll(filepath.Join(mappedRepoPath, dir), 0755); err != nil {
+				fatalLn("Cannot create ", filepath.Join(mappedRepoPath, dir), ": ", err)
+			}
+		}
+		// mapped directories are often public, e.g. docroots
+		if err = os.Chmod(mappedRepoPath, 0700); err != nil {
+			progressLn("Cannot chmod ", mappedRepoPath, ": ", err)
+		}
+	}
+
+	serverExcludes = NewExcludes(excludesFlag...)
+	serverExcludes.SetIncludes(includesFlag...)
+	if err := serverExcludes.SetSparse(sparseFlag...); err != nil {
+		fatalLn("Cannot parse --sparse: ", err)
+	}
+	parseSkipSettings(serverExcludes, skipFlags(), "command line")
+
+	removeStaleBigFiles()
 
 	go applyThread(os.Stdin)
 	go timeoutThread()
@@ -377,9 +579,9 @@ func doServer() {
 		select {
 		case <-pingTime:
 			pingTime = time.After(pingInterval)
-			os.Stdout.Write([]byte(actionPing))
+			writeToClient(actionPing, nil)
 		case <-signals:
-			os.Stdout.Write([]byte(actionStopServer))
+			writeToClient(actionStopServer, nil)
 			return
 		}
 	}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/glacjay/goini"
 	"github.com/unrealsync/unrealsync/list"
@@ -11,8 +12,11 @@ import (
 
 const generalSection = "general_settings"
 
+// generalOnlyKeys apply to the whole client, so they cannot be set for a single server
+var generalOnlyKeys = []string{"servers", "sparse", "priority", "burst-files", "burst-size", "gitignore", "hash", "exclude-presets"}
+
 type Settings struct {
-	excludes map[string]bool
+	excludes *Excludes
 	username string
 	sudouser string
 	host     string
@@ -24,13 +28,22 @@ type Settings struct {
 	batchMode          bool
 	compression        bool
 	sendQueueSizeLimit int64
+	reconcile          bool
+	verifyInterval     time.Duration
+	compactQueueSize   int64
+	bwLimit            int64
+	mappings           []pathMapping
+	normalizeNames     string
 }
 
-func parseServerSettings(section string, serverSettings map[string]string, excludes map[string]bool) Settings {
+func parseServerSettings(section string, serverSettings map[string]string, excludes *Excludes) Settings {
 
 	var (
 		port               int
 		sendQueueSizeLimit int
+		verifyInterval     int
+		compactQueueSize   = defaultCompactQueueSize
+		bwLimit            int64
 		err                error
 	)
 
@@ -48,18 +61,39 @@ func parseServerSettings(section string, serverSettings map[string]string, exclu
 		}
 	}
 
-	localExcludes := make(map[string]bool)
+	if serverSettings["compact-queue-size"] != "" {
+		compactQueueSize, err = strconv.Atoi(serverSettings["compact-queue-size"])
+		if err != nil {
+			fatalLn("Cannot parse 'compact-queue-size' property in [" + section + "] section of " + repoConfigFilename + ": " + err.Error())
+		}
+	}
 
-	for key, value := range excludes {
-		localExcludes[key] = value
+	if serverSettings["bwlimit"] != "" {
+		bwLimit, err = parseBwLimit(serverSettings["bwlimit"])
+		if err != nil {
+			fatalLn("Cannot parse 'bwlimit' property in [" + section + "] section of " + repoConfigFilename + ": " + err.Error())
+		}
 	}
 
-	if serverSettings["exclude"] != "" {
-		for key, value := range parseExcludes(serverSettings["exclude"]) {
-			localExcludes[key] = value
+	if serverSettings["verify-interval"] != "" {
+		verifyInterval, err = strconv.Atoi(serverSettings["verify-interval"])
+		if err != nil {
+			fatalLn("Cannot parse 'verify-interval' property in [" + section + "] section of " + repoConfigFilename + ": " + err.Error())
 		}
 	}
 
+	// server patterns go after the general ones, so they can override them
+	localExcludes := excludes.Copy()
+	if serverSettings["exclude"] != "" {
+		localExcludes.Add(parseExcludes(serverSettings["exclude"])...)
+	}
+	// server includes replace the general ones
+	if serverSettings["include"] != "" {
+		localExcludes.SetIncludes(parseExcludes(serverSettings["include"])...)
+	}
+	// general values are already inherited by serverSettings
+	parseSkipSettings(localExcludes, serverSettings, "["+section+"] section of "+repoConfigFilename)
+
 	host, ok := serverSettings["host"]
 	if !ok {
 		host = section
@@ -71,11 +105,33 @@ func parseServerSettings(section string, serverSettings map[string]string, exclu
 
 	batchMode := serverSettings["batchmode"] != "false"
 	compression := serverSettings["compression"] != "false"
+	reconcile := serverSettings["reconcile"] == "true" || reconcileFlag
 
 	if _, ok := serverSettings["dir"]; !ok {
 		fatalLn("ERR: Cannot start sync for section ", section, ". Remote dir is not specified neither in it nor in general section")
 	}
 
+	mappings, err := parseMappings(serverSettings["map"])
+	if err != nil {
+		fatalLn("Cannot parse 'map' property in [" + section + "] section of " + repoConfigFilename + ": " + err.Error())
+	}
+	if len(mappings) > 0 && reconcile {
+		progressLn("Reconciliation is not supported with 'map' in [" + section + "] section, rsync is used instead")
+		reconcile = false
+	}
+
+	normalizeNames, err := parseNormalizeNames(serverSettings["normalize-names"])
+	if err != nil {
+		fatalLn("Cannot parse 'normalize-names' property in [" + section + "] section of " + repoConfigFilename + ": " + err.Error())
+	}
+	if normalizeNames != "" && len(mappings) > 0 {
+		fatalLn("'normalize-names' cannot be used together with 'map' in [" + section + "] section of " + repoConfigFilename)
+	}
+	if normalizeNames != "" && !reconcile {
+		progressLn("Rsync cannot convert names, reconciliation is used for [" + section + "] section because of 'normalize-names'")
+		reconcile = true
+	}
+
 	return Settings{
 		localExcludes,
 		serverSettings["username"],
@@ -88,23 +144,23 @@ func parseServerSettings(section string, serverSettings map[string]string, exclu
 		batchMode,
 		compression,
 		int64(sendQueueSizeLimit),
+		reconcile,
+		time.Duration(verifyInterval) * time.Second,
+		int64(compactQueueSize),
+		bwLimit,
+		mappings,
+		normalizeNames,
 	}
 
 }
 
-func parseExcludes(excl string) map[string]bool {
-	result := make(map[string]bool)
-
-	for _, filename := range strings.Split(excl, "|") {
-		result[filename] = true
-	}
-
-	return result
+func parseExcludes(excl string) []string {
+	return strings.Split(excl, "|")
 }
 
-func parseConfig() (servers map[string]Settings, excludes map[string]bool) {
+func parseConfig() (servers map[string]Settings, excludes *Excludes) {
 	servers = make(map[string]Settings)
-	excludes = make(map[string]bool)
+	excludes = NewExcludes()
 	dict, err := ini.Load(repoConfigFilename)
 
 	if err != nil {
@@ -116,12 +172,49 @@ func parseConfig() (servers map[string]Settings, excludes map[string]bool) {
 		fatalLn("Section " + generalSection + " of config file " + repoConfigFilename + " is empty")
 	}
 
-	excludes[".unrealsync"] = true
+	if general["burst-files"] != "" {
+		if burstFiles, err = strconv.Atoi(general["burst-files"]); err != nil {
+			fatalLn("Cannot parse 'burst-files' property in " + generalSection + " section of " + repoConfigFilename + ": " + err.Error())
+		}
+	}
+	if general["burst-size"] != "" {
+		if burstSize, err = strconv.ParseInt(general["burst-size"], 10, 64); err != nil {
+			fatalLn("Cannot parse 'burst-size' property in " + generalSection + " section of " + repoConfigFilename + ": " + err.Error())
+		}
+	}
+
+	if general["priority"] != "" {
+		priorityPaths = parsePriority(general["priority"])
+	}
+
+	if general["gitignore"] == "true" {
+		useGitignore = true
+	}
+
+	if general["hash"] != "" && hashFlag == "" {
+		setHashAlgo(general["hash"], generalSection+" section of "+repoConfigFilename)
+	}
+
+	excludes = NewExcludes(".unrealsync")
+	if presetsFlag != "" {
+		excludes.Add(presetPatterns(presetsFlag, "--exclude-presets")...)
+	} else if general["exclude-presets"] != "" {
+		excludes.Add(presetPatterns(general["exclude-presets"], generalSection+" section of "+repoConfigFilename)...)
+	}
 	if general["exclude"] != "" {
-		for key, value := range parseExcludes(general["exclude"]) {
-			excludes[key] = value
+		excludes.Add(parseExcludes(general["exclude"])...)
+	}
+	if general["include"] != "" {
+		excludes.SetIncludes(parseExcludes(general["include"])...)
+	}
+	if len(sparseFlag) > 0 {
+		if err := excludes.SetSparse(sparseFlag...); err != nil {
+			fatalLn("Cannot parse --sparse: ", err)
 		}
+	} else if err := excludes.SetSparse(parseExcludes(general["sparse"])...); err != nil {
+		fatalLn("Cannot parse 'sparse' property in " + generalSection + " section of " + repoConfigFilename + ": " + err.Error())
 	}
+	parseSkipSettings(excludes, general, generalSection+" section of "+repoConfigFilename)
 
 	forceServers := general["servers"]
 	if forceServersFlag != "" {
@@ -143,8 +236,15 @@ func parseConfig() (servers map[string]Settings, excludes map[string]bool) {
 			continue
 		}
 
+		for _, generalKey := range generalOnlyKeys {
+			if _, ok := serverSettings[generalKey]; ok {
+				fatalLn("'" + generalKey + "' property can be set only in " + generalSection + " section of " + repoConfigFilename + ", found in [" + key + "]")
+			}
+		}
+
 		for generalKey, generalValue := range general {
-			if serverSettings[generalKey] == "" {
+			// general excludes and includes are already passed to parseServerSettings
+			if generalKey != "exclude" && generalKey != "include" && serverSettings[generalKey] == "" {
 				serverSettings[generalKey] = generalValue
 			}
 		}
@@ -171,5 +271,9 @@ func parseConfig() (servers map[string]Settings, excludes map[string]bool) {
 			servers[k] = parseServerSettings(k, serverSettings, excludes)
 		}
 	}
+
+	for _, settings := range servers {
+		excludes.addSpecialSkipTypes(settings.excludes)
+	}
 	return
 }
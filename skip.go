@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Besides patterns, files can be skipped by size (max-file-size, min-file-size) and by type (skip-types):
+//
+//	socket, fifo, device  special files
+//	core                  core dumps: regular files named core or core.<pid>
+//	*.iso                 files with the extension
+//
+// Sizes apply to regular files only. Skipped files are reported once instead of silently missing.
+// Special files are not known after they are written to the log, so if a server section skips them,
+// they are skipped for all servers, see addSpecialSkipTypes.
+
+var (
+	skipTypeNames = []string{"socket", "fifo", "device", "core"}
+	corePattern   = regexp.MustCompile(`^core(\.[0-9]+)?$`)
+)
+
+// parseSkipSettings reads max-file-size, min-file-size and skip-types from settings into excludes,
+// source is used in error messages
+func parseSkipSettings(excludes *Excludes, settings map[string]string, source string) {
+	var minSize, maxSize int64
+	var err error
+	if settings["max-file-size"] != "" {
+		if maxSize, err = parseSize(settings["max-file-size"]); err != nil {
+			fatalLn("Cannot parse 'max-file-size' property in " + source + ": " + err.Error())
+		}
+	}
+	if settings["min-file-size"] != "" {
+		if minSize, err = parseSize(settings["min-file-size"]); err != nil {
+			fatalLn("Cannot parse 'min-file-size' property in " + source + ": " + err.Error())
+		}
+	}
+	excludes.SetSizeLimits(minSize, maxSize)
+
+	if err = excludes.SetSkipTypes(strings.Split(settings["skip-types"], "|")...); err != nil {
+		fatalLn("Cannot parse 'skip-types' property in " + source + ": " + err.Error())
+	}
+}
+
+// skipFlags returns skip settings given by command line flags
+func skipFlags() map[string]string {
+	return map[string]string{"max-file-size": maxFileSizeFlag, "min-file-size": minFileSizeFlag, "skip-types": skipTypesFlag}
+}
+
+// SetSizeLimits sets limits of sizes of synced files, 0 means no limit
+func (e *Excludes) SetSizeLimits(minSize, maxSize int64) {
+	e.minFileSize, e.maxFileSize = minSize, maxSize
+}
+
+// SetSkipTypes replaces types of skipped files, see skipTypeNames
+func (e *Excludes) SetSkipTypes(types ...string) error {
+	e.skipTypes = nil
+	for _, skipType := range types {
+		skipType = strings.TrimSpace(skipType)
+		if skipType == "" {
+			continue
+		}
+		if !strings.HasPrefix(skipType, "*.") && !isSkipTypeName(skipType) {
+			return errors.New("unknown type " + skipType + ", supported are " + strings.Join(skipTypeNames, ", ") + " and *.<extension>")
+		}
+		e.skipTypes = append(e.skipTypes, skipType)
+	}
+	return nil
+}
+
+func isSkipTypeName(name string) bool {
+	for _, skipType := range skipTypeNames {
+		if name == skipType {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *Excludes) SkipTypes() []string {
+	return e.skipTypes
+}
+
+// addSpecialSkipTypes adds types of special files skipped by other, because they cannot be skipped
+// for a single server after they got into the log
+func (e *Excludes) addSpecialSkipTypes(other *Excludes) {
+	for _, skipType := range other.skipTypes {
+		if skipType != "socket" && skipType != "fifo" && skipType != "device" {
+			continue
+		}
+		found := false
+		for _, existing := range e.skipTypes {
+			found = found || existing == skipType
+		}
+		if !found {
+			e.skipTypes = append(e.skipTypes, skipType)
+		}
+	}
+}
+
+// Skips returns the reason why the file is skipped or "" if it is not
+func (e *Excludes) Skips(file string, mode os.FileMode, size int64) string {
+	if e == nil || mode.IsDir() || mode&os.ModeSymlink != 0 {
+		return ""
+	}
+
+	if mode.IsRegular() {
+		if e.maxFileSize > 0 && size > e.maxFileSize {
+			return "bigger than max-file-size"
+		}
+		if size < e.minFileSize {
+			return "smaller than min-file-size"
+		}
+	}
+
+	name := filepath.Base(file)
+	for _, skipType := range e.skipTypes {
+		var skipped bool
+		switch skipType {
+		case "socket":
+			skipped = mode&os.ModeSocket != 0
+		case "fifo":
+			skipped = mode&os.ModeNamedPipe != 0
+		case "device":
+			skipped = mode&os.ModeDevice != 0
+		case "core":
+			skipped = mode.IsRegular() && corePattern.MatchString(name)
+		default:
+			skipped = strings.HasSuffix(name, skipType[1:])
+		}
+		if skipped {
+			return "type is " + skipType
+		}
+	}
+	return ""
+}
+
+// SkipsStat is Skips for a stat from a diff, it does not know about special files
+func (e *Excludes) SkipsStat(file string, stat *UnrealStat) string {
+	if stat == nil || stat.isDir || stat.isLink {
+		return ""
+	}
+	return e.Skips(file, 0, stat.size)
+}
+
+// skipRsyncArgs returns rsync arguments for the same limits. Rsync cannot skip only sockets or only fifos,
+// so both of them are skipped if either is, and regular files named "core" are not skipped by rsync
+func (e *Excludes) skipRsyncArgs() []string {
+	var args []string
+	if e.maxFileSize > 0 {
+		args = append(args, "--max-size="+strconv.FormatInt(e.maxFileSize, 10))
+	}
+	if e.minFileSize > 0 {
+		args = append(args, "--min-size="+strconv.FormatInt(e.minFileSize, 10))
+	}
+
+	specials := false
+	for _, skipType := range e.skipTypes {
+		switch skipType {
+		case "socket", "fifo":
+			if !specials {
+				args = append(args, "--no-specials")
+				specials = true
+			}
+		case "device":
+			args = append(args, "--no-devices")
+		case "core":
+			args = append(args, "--exclude=core.[0-9]*")
+		default:
+			args = append(args, "--exclude="+skipType)
+		}
+	}
+	return args
+}
+
+// skipReporter makes sure that every skipped file is reported only once
+type skipReporter struct {
+	sync.Mutex
+	reported map[string]string
+}
+
+func (s *skipReporter) report(file string, reason string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.reported == nil {
+		s.reported = make(map[string]string)
+	}
+	if s.reported[file] != reason {
+		s.reported[file] = reason
+		progressLn("Skipping ", file, ": ", reason)
+	}
+}
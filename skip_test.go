@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestExcludesSkips(t *testing.T) {
+	tests := []struct {
+		types   []string
+		minSize int64
+		maxSize int64
+		file    string
+		mode    os.FileMode
+		size    int64
+		want    string
+	}{
+		{nil, 0, 0, "a/file", 0, 100, ""},
+		{nil, 0, 1000, "a/file", 0, 1000, ""},
+		{nil, 0, 1000, "a/file", 0, 1001, "bigger than max-file-size"},
+		{nil, 10, 0, "a/file", 0, 9, "smaller than min-file-size"},
+		{nil, 10, 1000, "a/dir", os.ModeDir, 1, ""},
+		{nil, 10, 1000, "a/link", os.ModeSymlink, 1, ""},
+		{nil, 10, 0, "a/fifo", os.ModeNamedPipe, 0, ""},
+		{[]string{"fifo"}, 0, 0, "a/fifo", os.ModeNamedPipe, 0, "type is fifo"},
+		{[]string{"fifo"}, 0, 0, "a/socket", os.ModeSocket, 0, ""},
+		{[]string{"socket"}, 0, 0, "a/socket", os.ModeSocket, 0, "type is socket"},
+		{[]string{"device"}, 0, 0, "a/sda", os.ModeDevice, 0, "type is device"},
+		{[]string{"core"}, 0, 0, "a/core", 0, 100, "type is core"},
+		{[]string{"core"}, 0, 0, "a/core.1234", 0, 100, "type is core"},
+		{[]string{"core"}, 0, 0, "a/core.go", 0, 100, ""},
+		{[]string{"core"}, 0, 0, "a/core", os.ModeDir, 100, ""},
+		{[]string{"*.iso"}, 0, 0, "a/image.iso", 0, 100, "type is *.iso"},
+		{[]string{"*.iso"}, 0, 0, "a/image.isox", 0, 100, ""},
+	}
+
+	for _, test := range tests {
+		excludes := NewExcludes()
+		excludes.SetSizeLimits(test.minSize, test.maxSize)
+		if err := excludes.SetSkipTypes(test.types...); err != nil {
+			t.Fatal(err)
+		}
+		if got := excludes.Skips(test.file, test.mode, test.size); got != test.want {
+			t.Errorf("types %q, sizes %d-%d: Skips(%q, %v, %d) = %q, want %q", test.types, test.minSize, test.maxSize, test.file, test.mode, test.size, got, test.want)
+		}
+	}
+}
+
+func TestSetSkipTypes(t *testing.T) {
+	if err := NewExcludes().SetSkipTypes("socket", " *.iso", "", "core"); err != nil {
+		t.Errorf("SetSkipTypes() = %v, want no error", err)
+	}
+	if err := NewExcludes().SetSkipTypes("pipe"); err == nil {
+		t.Errorf("SetSkipTypes(\"pipe\") = nil, want error")
+	}
+}
+
+func TestSkipRsyncArgs(t *testing.T) {
+	excludes := NewExcludes()
+	excludes.SetSizeLimits(10, 1048576)
+	if err := excludes.SetSkipTypes("socket", "fifo", "device", "core", "*.iso"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"--max-size=1048576", "--min-size=10", "--no-specials", "--no-devices", "--exclude=core.[0-9]*", "--exclude=*.iso"}
+	if got := excludes.skipRsyncArgs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("skipRsyncArgs() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Sparse paths limit sync to a few subtrees of a huge directory: with "sparse = services/foo|libs/common"
+// only these directories are scanned, watched and synced. Unlike includes, nothing outside of them is ever
+// read: parent directories are not listed, only the entries that lead to sparse paths are checked.
+// Excludes and includes still apply inside of sparse paths.
+
+// parseSparsePaths cleans root-relative paths and drops the ones inside of other sparse paths.
+// "." means the whole directory, so no paths are returned
+func parseSparsePaths(paths []string) ([]string, error) {
+	var result []string
+	for _, p := range paths {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		p = path.Clean(strings.Trim(p, "/"))
+		if p == "." {
+			return nil, nil
+		}
+		if p == ".." || strings.HasPrefix(p, "../") {
+			return nil, errors.New("path '" + p + "' is outside of the synced directory")
+		}
+		result = append(result, p)
+	}
+
+	sort.Strings(result)
+	var sparse []string
+	for _, p := range result {
+		nested := false
+		for _, dir := range sparse {
+			nested = nested || isInside(p, dir)
+		}
+		if !nested {
+			sparse = append(sparse, p)
+		}
+	}
+	return sparse, nil
+}
+
+// isInside reports whether p is dir itself or a path inside of it
+func isInside(p, dir string) bool {
+	return dir == "." || p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// SetSparse replaces sparse paths, no paths means the whole directory
+func (e *Excludes) SetSparse(paths ...string) error {
+	sparse, err := parseSparsePaths(paths)
+	if err != nil {
+		return err
+	}
+	e.sparse = sparse
+	return nil
+}
+
+func (e *Excludes) Sparse() []string {
+	return e.sparse
+}
+
+// sparseAllows reports whether path is inside of sparse paths or is a directory on the way to them
+func (e *Excludes) sparseAllows(path string, isDir bool) bool {
+	if len(e.sparse) == 0 {
+		return true
+	}
+	for _, dir := range e.sparse {
+		if isInside(path, dir) || isDir && isInside(dir, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// sparseChildren returns names of entries of dir that lead to sparse paths, or nil if dir
+// must be read as usual
+func (e *Excludes) sparseChildren(dir string) []string {
+	var names []string
+	for _, p := range e.sparse {
+		if isInside(dir, p) {
+			return nil
+		}
+		if !isInside(p, dir) {
+			continue
+		}
+		name := p
+		if dir != "." {
+			name = p[len(dir)+1:]
+		}
+		name = strings.SplitN(name, "/", 2)[0]
+		if len(names) == 0 || names[len(names)-1] != name {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// sparseRoots returns directories under dir that must be read recursively
+func (e *Excludes) sparseRoots(dir string) []string {
+	var roots []string
+	for _, p := range e.sparse {
+		if isInside(dir, p) {
+			return []string{dir}
+		}
+		if isInside(p, dir) {
+			roots = append(roots, p)
+		}
+	}
+	if len(e.sparse) == 0 {
+		return []string{dir}
+	}
+	return roots
+}
+
+// sparseUnder returns sparse paths for the subtree at prefix as if it was the root, see Under
+func (e *Excludes) sparseUnder(prefix string) []string {
+	var result []string
+	for _, p := range e.sparse {
+		if isInside(prefix, p) {
+			return nil
+		}
+		if isInside(p, prefix) {
+			result = append(result, p[len(prefix)+1:])
+		}
+	}
+	return result
+}
+
+// sparseRsyncArgs returns rsync filter arguments that include the way to sparse paths and exclude
+// everything beside it. Rsync uses the first matching rule, so they go before all other arguments,
+// and sparse paths that are excluded are dropped, so that their parents are not included back
+func (e *Excludes) sparseRsyncArgs() []string {
+	var args []string
+	dirs := []string{"."}
+	for len(dirs) > 0 {
+		dir := dirs[0]
+		dirs = dirs[1:]
+
+		names := e.sparseChildren(dir)
+		if len(names) == 0 {
+			continue
+		}
+		prefix := "/"
+		if dir != "." {
+			prefix = "/" + dir + "/"
+		}
+		for _, name := range names {
+			child := path.Join(dir, name)
+			if e.Match(child, true) {
+				continue
+			}
+			args = append(args, "--include="+prefix+name+"/")
+			dirs = append(dirs, child)
+		}
+		args = append(args, "--exclude="+prefix+"*")
+	}
+	return args
+}
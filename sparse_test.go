@@ -0,0 +1,125 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSparsePaths(t *testing.T) {
+	tests := []struct {
+		paths   []string
+		want    []string
+		wantErr bool
+	}{
+		{nil, nil, false},
+		{[]string{"", " "}, nil, false},
+		{[]string{"services/foo", "libs/common"}, []string{"libs/common", "services/foo"}, false},
+		{[]string{"/services/foo/", "services/./bar"}, []string{"services/bar", "services/foo"}, false},
+		{[]string{"services", "services/foo", "servicesx"}, []string{"services", "servicesx"}, false},
+		{[]string{"services/foo", "."}, nil, false},
+		{[]string{"../foo"}, nil, true},
+		{[]string{"a/../.."}, nil, true},
+	}
+
+	for _, test := range tests {
+		got, err := parseSparsePaths(test.paths)
+		if (err != nil) != test.wantErr || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseSparsePaths(%q) = %q, %v, want %q, error %v", test.paths, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func newSparseExcludes(t *testing.T, patterns []string, sparse ...string) *Excludes {
+	excludes := NewExcludes(patterns...)
+	if err := excludes.SetSparse(sparse...); err != nil {
+		t.Fatal(err)
+	}
+	return excludes
+}
+
+func TestSparseAllows(t *testing.T) {
+	excludes := newSparseExcludes(t, nil, "services/foo", "libs/common")
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"services", true, true},
+		{"services", false, false},
+		{"services/foo", true, true},
+		{"services/foo/main.go", false, true},
+		{"services/bar", true, false},
+		{"services/foobar", true, false},
+		{"libs/common/x/y", false, true},
+		{"README.md", false, false},
+	}
+
+	for _, test := range tests {
+		if got := excludes.Allows(test.path, test.isDir); got != test.want {
+			t.Errorf("Allows(%q, %v) = %v, want %v", test.path, test.isDir, got, test.want)
+		}
+	}
+}
+
+func TestSparseDirs(t *testing.T) {
+	excludes := newSparseExcludes(t, nil, "services/foo", "services/bar/baz", "libs")
+	tests := []struct {
+		dir      string
+		children []string
+		roots    []string
+		under    []string
+	}{
+		{".", []string{"libs", "services"}, []string{"libs", "services/bar/baz", "services/foo"}, []string{"libs", "services/bar/baz", "services/foo"}},
+		{"services", []string{"bar", "foo"}, []string{"services/bar/baz", "services/foo"}, []string{"bar/baz", "foo"}},
+		{"services/bar", []string{"baz"}, []string{"services/bar/baz"}, []string{"baz"}},
+		{"services/foo", nil, []string{"services/foo"}, nil},
+		{"libs/x", nil, []string{"libs/x"}, nil},
+		{"other", nil, nil, nil},
+	}
+
+	for _, test := range tests {
+		if got := excludes.sparseChildren(test.dir); !reflect.DeepEqual(got, test.children) {
+			t.Errorf("sparseChildren(%q) = %q, want %q", test.dir, got, test.children)
+		}
+		if got := excludes.sparseRoots(test.dir); !reflect.DeepEqual(got, test.roots) {
+			t.Errorf("sparseRoots(%q) = %q, want %q", test.dir, got, test.roots)
+		}
+		if test.dir != "." {
+			if got := excludes.sparseUnder(test.dir); !reflect.DeepEqual(got, test.under) {
+				t.Errorf("sparseUnder(%q) = %q, want %q", test.dir, got, test.under)
+			}
+		}
+	}
+
+	if got := NewExcludes().sparseRoots("src"); !reflect.DeepEqual(got, []string{"src"}) {
+		t.Errorf("sparseRoots(\"src\") without sparse paths = %q, want [\"src\"]", got)
+	}
+}
+
+func TestSparseRsyncArgs(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		sparse   []string
+		want     []string
+	}{
+		{nil, nil, nil},
+		{nil, []string{"libs"}, []string{"--include=/libs/", "--exclude=/*"}},
+		{nil, []string{"services/foo", "services/bar/baz", "libs"}, []string{
+			"--include=/libs/", "--include=/services/", "--exclude=/*",
+			"--include=/services/bar/", "--include=/services/foo/", "--exclude=/services/*",
+			"--include=/services/bar/baz/", "--exclude=/services/bar/*",
+		}},
+		// excluded sparse paths are not included back
+		{[]string{"/services/bar"}, []string{"services/foo", "services/bar/baz"}, []string{
+			"--include=/services/", "--exclude=/*",
+			"--include=/services/foo/", "--exclude=/services/*",
+		}},
+	}
+
+	for _, test := range tests {
+		excludes := newSparseExcludes(t, test.patterns, test.sparse...)
+		if got := excludes.sparseRsyncArgs(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("sparse %q: sparseRsyncArgs() = %q, want %q", test.sparse, got, test.want)
+		}
+	}
+}
@@ -1,9 +1,7 @@
 package main
 
 import (
-	"crypto/md5"
 	"fmt"
-	"io"
 	"os"
 	"strconv"
 	"strings"
@@ -32,6 +30,34 @@ func (s UnrealStat) Serialize() (res string) {
 	return
 }
 
+// Fingerprint contains exactly the fields that StatsEqual compares, so it can be used
+// to compare stats of the same file on different hosts
+func (s *UnrealStat) Fingerprint() string {
+	if s.isDir {
+		return fmt.Sprintf("dir mode=%o", s.mode&0777)
+	}
+	if s.isLink {
+		return fmt.Sprintf("symlink size=%d", s.size)
+	}
+	if hashCheck {
+		// files that cannot be hashed are compared as if there were no --hash-check
+		if hash, err := s.Hash(); err == nil {
+			return fmt.Sprintf("mode=%o size=%d hash=%s", s.mode&0777, s.size, hash)
+		}
+	}
+	return fmt.Sprintf("mode=%o size=%d mtime=%d", s.mode&0777, s.size, s.mtime)
+}
+
+// Kind returns 'd' for directories, 'l' for symlinks and 'f' for regular files
+func (s *UnrealStat) Kind() byte {
+	if s.isDir {
+		return 'd'
+	} else if s.isLink {
+		return 'l'
+	}
+	return 'f'
+}
+
 func StatsEqual(newStat UnrealStat, oldStat UnrealStat) bool {
 	if newStat.isDir != oldStat.isDir {
 		debugLn(newStat.name, " is not dir")
@@ -69,14 +95,28 @@ func hashEqual(newStat UnrealStat, oldStat UnrealStat) bool {
 		return false
 	}
 
-	return oldStat.hash == newStat.Hash()
+	if oldStat.hash == "" {
+		return false
+	}
+
+	hash, err := newStat.Hash()
+	if err != nil {
+		debugLn("Cannot hash ", newStat.name, ": ", err)
+		return false
+	}
+	return oldStat.hash == hash
 }
 
-func (s *UnrealStat) Hash() string {
+// Hash returns encoded digest of file contents, it is computed once
+func (s *UnrealStat) Hash() (string, error) {
 	if s.hash == "" {
-		s.hash = computeMd5(s.name)
+		hash, err := computeHash(s.name)
+		if err != nil {
+			return "", err
+		}
+		s.hash = hash
 	}
-	return s.hash
+	return s.hash, nil
 }
 
 func UnrealStatUnserialize(input string) (result UnrealStat) {
@@ -109,18 +149,3 @@ func UnrealStatFromStat(filePath string, info os.FileInfo) UnrealStat {
 		"",
 	}
 }
-
-func computeMd5(filePath string) string {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return ""
-	}
-	defer file.Close()
-
-	hash := md5.New()
-	if _, err := io.Copy(hash, file); err != nil {
-		return ""
-	}
-
-	return string(hash.Sum(nil))
-}
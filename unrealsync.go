@@ -13,13 +13,15 @@ import (
 )
 
 const (
-	version = "1.0.11"
+	version = "1.5.0"
 
 	// Files stored in repo folder
 	defaultRepoDir        = ".unrealsync/"
 	repoConfigFilename    = defaultRepoDir + "client_config"
 	repoTmp               = "tmp"
+	repoBigTmp            = "big" // partially received big files, kept between restarts
 	repoLogFilename       = "out.log"
+	repoIndexFilename     = "index"
 	repoPidFilename       = "pid"
 	repoPidServerFilename = "pid_server"
 
@@ -33,9 +35,21 @@ const (
 	actionBigRcv     = "BIGRCV    "
 	actionBigCommit  = "BIGCOMMIT "
 	actionBigAbort   = "BIGABORT  "
+	actionBigKeep    = "BIGKEEP   "
 	actionStopServer = "STOPSERVER"
+	// written only to the log instead of big file contents: filename length | filename | stat
+	actionBigRef = "BIGREF    "
+	// unlike other actions sent by server, these are followed by length and payload
+	actionTreeRequest = "TREEREQ   "
+	actionTreeReply   = "TREEREP   "
+	actionBigHave     = "BIGHAVE   "
+	actionCopyMiss    = "COPYMISS  "
 
 	maxDiffSize           = 2 * 1024 * 1204
+	bigFileThreshold      = maxDiffSize / 2 // bigger files are not batched with others, see DiffWriter.Add
+	minCopySize           = 4096            // smaller files are always sent as is
+	bigFileChunkSize      = 256 * 1024      // small enough for diffs not to wait long between chunks
+	bigFileKeepTime       = 24 * time.Hour  // partially received big files are kept this long for resuming
 	defaultConnectTimeout = 10
 	retryInterval         = 10 * time.Second
 	serverAliveInterval   = 3
@@ -43,6 +57,7 @@ const (
 
 	pingInterval         = time.Minute
 	dirAggregateInterval = 400 * time.Millisecond
+	stopTimeout          = 30 * time.Second // previous instance is killed if it does not stop in time
 )
 
 type MultipleStringFlag []string
@@ -68,22 +83,45 @@ var (
 	isHelp           = false
 	hostname         = ""
 	excludesFlag     MultipleStringFlag
+	includesFlag     MultipleStringFlag
+	maxFileSizeFlag  = ""
+	minFileSizeFlag  = ""
+	skipTypesFlag    = ""
+	presetsFlag      = ""
+	mapFlag          MultipleStringFlag
+	sparseFlag       MultipleStringFlag
+	isWatch          = false
+	isListPresets    = false
 	forceServersFlag = ""
 	hashCheck        = false
+	hashFlag         = ""
+	reconcileFlag    = false
 )
 
 func init() {
 	flag.BoolVar(&isHelp, "help", false, "Show help and exit")
 	flag.BoolVar(&isVersion, "version", false, "Show version and exit")
 	flag.BoolVar(&isDebug, "debug", false, "Turn on debugging information")
-	flag.Var(&excludesFlag, "exclude", "Exclude specified path from sync. Also used as internal parameter on the remote side")
+	flag.Var(&includesFlag, "include", "Sync only paths matching pattern (relative to the root), can be repeated. Also used as internal parameter on the remote side")
+	flag.StringVar(&maxFileSizeFlag, "max-file-size", "", "Skip files bigger than this size, e.g. 100MB")
+	flag.StringVar(&minFileSizeFlag, "min-file-size", "", "Skip files smaller than this size")
+	flag.StringVar(&skipTypesFlag, "skip-types", "", "Skip files of these types separated by |: socket, fifo, device, core, *.<extension>")
+	flag.StringVar(&presetsFlag, "exclude-presets", "", "Exclude temporary files of comma separated presets, see --list-exclude-presets")
+	flag.BoolVar(&isListPresets, "list-exclude-presets", false, "Show available exclude presets and their patterns and exit")
+	flag.Var(&sparseFlag, "sparse", "Sync only this directory (relative to the root) and never read the rest of the tree, can be repeated. Also used as internal parameter on the remote side")
+	flag.Var(&excludesFlag, "exclude", "Exclude paths matching gitignore-style pattern from sync, can be repeated. Also used as internal parameter on the remote side")
 	flag.StringVar(&forceServersFlag, "servers", "", "Perform sync only for specified servers")
 	flag.StringVar(&repoPath, "repo-path", "", "Store logs and pid file in specified folder")
 	flag.StringVar(&sudoUser, "sudo-user", "", "Use this user to store files on the remote side")
 	flag.StringVar(&remoteBinPath, "remote-bin-path", "", "Specify the unrealsync path to run on remote side")
-	flag.BoolVar(&hashCheck, "hash-check", false, "Use md5 hashing to check if file content changed before syncing it")
+	flag.BoolVar(&hashCheck, "hash-check", false, "Use hashing to check if file content changed before syncing it")
+	flag.StringVar(&hashFlag, "hash", "", "Hash algorithm for file contents: "+hashAlgoNames()+" (default "+defaultHashAlgo+")")
+	flag.BoolVar(&useGitignore, "gitignore", false, "Also read exclude patterns from .gitignore files (.unrealsyncignore files are always read)")
+	flag.BoolVar(&reconcileFlag, "reconcile", false, "Use hash tree reconciliation instead of rsync for initial sync")
 	// keep internal parameters to be the last; todo: find something to replace flag and hide internal from .PrintDefault()'s output
 	flag.BoolVar(&isServer, "server", false, "(internal) Internal parameter used on remote side")
+	flag.Var(&mapFlag, "map", "(internal) Place subtree at prefix into another directory: prefix=>dir")
+	flag.BoolVar(&isWatch, "watch", false, "(internal) Watch directory and print changed paths")
 	flag.StringVar(&hostname, "hostname", "", "(internal) Internal parameter used on remote side")
 }
 
@@ -138,8 +176,13 @@ func writePidFileAndKillPrevious(pidFilename string) {
 		proc, err := os.FindProcess(pid)
 		if err == nil {
 			proc.Signal(syscall.SIGUSR1)
-			// give some time for process to stop normally
-			time.Sleep(250 * time.Millisecond)
+			// give process time to save index and stop normally
+			for deadline := time.Now().Add(stopTimeout); time.Now().Before(deadline); {
+				if proc.Signal(syscall.Signal(0)) != nil {
+					break
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
 			// need this for back-compatibility. Need to drop with major version inc
 			proc.Kill()
 		}
@@ -161,18 +204,28 @@ func writePidFileAndKillPrevious(pidFilename string) {
 
 func main() {
 	var err error
-	var globalExcludes map[string]bool
+	var globalExcludes *Excludes
 	servers := make(map[string]Settings)
 
 	flag.Parse()
 	args := flag.Args()
 
+	if hashFlag != "" {
+		setHashAlgo(hashFlag, "--hash")
+	}
+
 	if isHelp {
 		printHelp()
 		os.Exit(0)
 	} else if isVersion {
 		fmt.Println(version)
 		os.Exit(0)
+	} else if isListPresets {
+		printExcludePresets()
+		os.Exit(0)
+	} else if isWatch && len(args) == 1 {
+		doWatch(args[0])
+		os.Exit(0)
 	} else if len(args) > 0 {
 		var err error
 		if len(repoPath) != 0 {
@@ -186,13 +239,14 @@ func main() {
 		if err := os.Chdir(args[0]); err != nil {
 			fatalLn("Cannot chdir to ", args[0])
 		}
-		if len(excludesFlag) > 0 {
-			globalExcludes = make(map[string]bool)
-			for _, exclude := range excludesFlag {
-				globalExcludes[exclude] = true
-			}
-			globalExcludes[".unrealsync"] = true
+		globalExcludes = NewExcludes(".unrealsync")
+		globalExcludes.Add(presetPatterns(presetsFlag, "--exclude-presets")...)
+		globalExcludes.Add(excludesFlag...)
+		globalExcludes.SetIncludes(includesFlag...)
+		if err := globalExcludes.SetSparse(sparseFlag...); err != nil {
+			fatalLn("Cannot parse --sparse: ", err)
 		}
+		parseSkipSettings(globalExcludes, skipFlags(), "command line")
 		for i := 1; i < len(args); i++ {
 			parts := strings.Split(args[i], ":")
 			if len(parts) != 2 {
@@ -210,12 +264,9 @@ func main() {
 			if len(remoteBinPath) > 0 {
 				serverSettings.remoteBinPath = remoteBinPath
 			}
-			if len(globalExcludes) > 0 {
-				serverSettings.excludes = make(map[string]bool)
-				for k, v := range globalExcludes {
-					serverSettings.excludes[k] = v
-				}
-			}
+			serverSettings.reconcile = reconcileFlag
+			serverSettings.compactQueueSize = defaultCompactQueueSize
+			serverSettings.excludes = globalExcludes.Copy()
 			servers[serverSettings.host] = serverSettings
 		}
 	} else {
@@ -239,7 +290,7 @@ func main() {
 	tmpFolder := path.Join(repoPath, repoTmp)
 	os.RemoveAll(tmpFolder)
 
-	for _, dir := range []string{repoPath, tmpFolder} {
+	for _, dir := range []string{repoPath, tmpFolder, path.Join(repoPath, repoBigTmp)} {
 		_, err = os.Stat(dir)
 		if err != nil {
 			err = os.Mkdir(dir, 0755)
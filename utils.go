@@ -155,3 +155,8 @@ func versionToIntArray(version string) ([]int, error) {
 	}
 	return intVersion, nil
 }
+
+// shellQuote quotes s for the remote shell that runs commands passed to ssh
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
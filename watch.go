@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/unrealsync/fswatcher"
+)
+
+// fswatcher can watch only one directory per process, so when there are several sparse paths
+// each of them is watched by a separate "unrealsync --watch <dir>" process that prints changed
+// paths line by line. Watcher process exits when its stdin is closed, i.e. when the client exits.
+
+// startWatchers starts watching the synced directory or its sparse paths and returns
+// the number of watchers, each of them sends fswatcher.LOCAL_WATCHER_READY when it is ready
+func startWatchers(dirschan chan string) int {
+	roots := repo.excludes.sparseRoots(".")
+	if len(roots) == 1 {
+		go fswatcher.RunWatcher(filepath.Join(sourceDir, roots[0]), dirschan)
+		return 1
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		fatalLn("Cannot find unrealsync executable to watch sparse paths: ", err)
+	}
+	for _, root := range roots {
+		go runWatcherProcess(executable, filepath.Join(sourceDir, root), dirschan)
+	}
+	return len(roots)
+}
+
+func runWatcherProcess(executable string, dir string, dirschan chan string) {
+	cmd := exec.Command(executable, "--watch", dir)
+	cmd.Stderr = os.Stderr
+
+	// stdin is never written, it is closed when we exit
+	if _, err := cmd.StdinPipe(); err != nil {
+		fatalLn("Cannot create stdin pipe for watcher of ", dir, ": ", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		fatalLn("Cannot create stdout pipe for watcher of ", dir, ": ", err)
+	}
+	if err = cmd.Start(); err != nil {
+		fatalLn("Cannot start watcher for ", dir, ": ", err)
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		dirschan <- scanner.Text()
+	}
+	fatalLn("Watcher for ", dir, " has stopped: ", cmd.Wait())
+}
+
+// doWatch is the watcher process, see runWatcherProcess
+func doWatch(dir string) {
+	go func() {
+		io.Copy(ioutil.Discard, os.Stdin)
+		os.Exit(0)
+	}()
+
+	changes := make(chan string, 10000)
+	go fswatcher.RunWatcher(dir, changes)
+	out := bufio.NewWriter(os.Stdout)
+	for change := range changes {
+		out.WriteString(change + "\n")
+		// buffered changes are written together
+		if len(changes) == 0 {
+			if err := out.Flush(); err != nil {
+				os.Exit(1)
+			}
+		}
+	}
+}